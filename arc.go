@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// responseWrapper is the envelope of every arc query response
+type responseWrapper struct {
+	Response struct {
+		Docs []json.RawMessage `json:"docs"`
+	} `json:"response"`
+}
+
+type imageFormat struct {
+	TypeName string `json:"typeName"`
+}
+
+// imageAssetRefs is a stored image file of an arc image
+type imageAssetRefs struct {
+	Format imageFormat `json:"format"`
+	Height uint        `json:"height"`
+	Width  uint        `json:"width"`
+	URI    string      `json:"URI"`
+}
+
+// virtualImageParams is an editor defined crop set of an arc image
+type virtualImageParams struct {
+	TopLeftX       int  `json:"topLeftX"`
+	TopLeftY       int  `json:"topLeftY"`
+	CropSizeWidth  uint `json:"cropSizeWidth"`
+	CropSizeHeight uint `json:"cropSizeHeight"`
+}
+
+// focalPoint is the editor defined subject of an arc image as fractions of the width and height from the top left
+type focalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type image struct {
+	ImageAssetRefs     []imageAssetRefs     `json:"imageAssetRefs"`
+	VirtualImageParams []virtualImageParams `json:"virtualImageParams"`
+	FocalPoint         *focalPoint          `json:"focalPoint"`
+}
+
+// item is either an arc image itself or an object such as a video or series holding images
+type item struct {
+	Images             []image `json:"Images"`
+	ImagesWithCaptions []struct {
+		Image image `json:"Image"`
+	} `json:"ImagesWithCaptions"`
+	image
+}
+
+// invalidMgidError is returned for mgids that can't be looked up in arc
+type invalidMgidError struct {
+	id     string
+	reason string
+}
+
+func (e *invalidMgidError) Error() string {
+	return "invalid mgid " + e.id + ": " + e.reason
+}
+
+// arcNotFoundError is returned when arc has no object or no images for the id
+type arcNotFoundError struct {
+	id string
+}
+
+func (e *arcNotFoundError) Error() string {
+	return "no arc images found for id: " + e.id
+}
+
+// arcDecodeError is returned when the arc response is not the expected json
+type arcDecodeError struct {
+	id  string
+	err error
+}
+
+func (e *arcDecodeError) Error() string {
+	return "failed to decode arc response for id " + e.id + ": " + e.err.Error()
+}
+
+// arcFetchError is returned when arc can't be reached or returns an error status
+type arcFetchError struct {
+	url string
+	err error
+}
+
+func (e *arcFetchError) Error() string {
+	return "failed to fetch arc object " + e.url + ": " + e.err.Error()
+}
+
+// uintDiff is the absolute difference of a and b without wrapping around
+func uintDiff(a uint, b uint) float64 {
+	return math.Abs(float64(a) - float64(b))
+}
+
+func getObjectHelper(id string, namespace string, pd *parametersData) (json.RawMessage, error) {
+	var o []byte
+	var rerr error
+	u := strings.Replace(imageIDQuery, "[NAMESPACE]", namespace, 1)
+	u = strings.Replace(u, "[KEYID]", id, 1)
+	pd.log("Fetching arc call: " + u)
+	//check cache to see if we've already made this call
+	if pd.cacheRefresh == false {
+		cc := redisClient.Get(redisKeyCacheObjectPrefix + u)
+		o, _ = cc.Bytes()
+	}
+	if o == nil {
+		//go get the data from arc
+		pd.log("fetching data from arc not found in cache")
+		o, _, rerr = httpGet(pd.context(), u)
+		if rerr != nil {
+			fmt.Println("Error remote url fetch for object by url: ", u, rerr)
+			pd.log("Error remote url fetch for object by url: " + rerr.Error())
+			return nil, &arcFetchError{url: u, err: rerr}
+		}
+
+		//save in cache
+		redisClient.Set(redisKeyCacheObjectPrefix+u, o, objectCacheTimeout)
+	}
+
+	var data responseWrapper
+
+	if err := json.Unmarshal(o, &data); err != nil {
+		fmt.Println("Failed to decode arc response: ", u, err)
+		pd.log("Failed to decode arc response: " + err.Error())
+		//don't keep serving a bad response from the cache
+		redisClient.Del(redisKeyCacheObjectPrefix + u)
+		return nil, &arcDecodeError{id: id, err: err}
+	}
+
+	if len(data.Response.Docs) != 1 {
+		fmt.Println("Failed to fetch object by id:", id, " url: ", u)
+		pd.log("Failed to fetch object by id: " + id)
+		return nil, &arcNotFoundError{id: id}
+	}
+	return data.Response.Docs[0], nil
+}
+
+// getArcImages looks up the arc object mgid id returning its images that have an asset in the order /oid/ prefers them,
+// the image itself for an image object or the captioned images then the other images for an item
+func getArcImages(id string, pd *parametersData) ([]image, error) {
+	var item item
+	var imgs []image
+
+	mgidPieces := strings.Split(id, ":")
+
+	//example mgid
+	//mgid:arc:video:<namespace>:<uuid>
+	//TODO: allow for other handlers besides arc
+	if len(mgidPieces) < 5 {
+		//invalid mgid, mgids must be 5 pieces
+		return nil, &invalidMgidError{id: id, reason: "mgids must have 5 pieces"}
+	}
+
+	if mgidPieces[1] != "arc" {
+		fmt.Println("invalid provider we only support arc currently")
+		pd.log("invalid provider we only support arc currently")
+		return nil, &invalidMgidError{id: id, reason: "only the arc provider is supported"}
+	}
+	raw, err := getObjectHelper(mgidPieces[4], mgidPieces[3], pd)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return nil, &arcDecodeError{id: id, err: err}
+	}
+
+	if len(item.ImageAssetRefs) > 0 {
+		//image object
+		imgs = append(imgs, item.image)
+	} else {
+		//item object
+		//check imagewithcaptions first then images
+		for i := 0; i < len(item.ImagesWithCaptions); i++ {
+			imgs = append(imgs, item.ImagesWithCaptions[i].Image)
+		}
+		for i := 0; i < len(item.Images); i++ {
+			imgs = append(imgs, item.Images[i])
+		}
+	}
+
+	//images without an asset have nothing to serve
+	ai := imgs[:0]
+	for _, v := range imgs {
+		if len(v.ImageAssetRefs) > 0 {
+			ai = append(ai, v)
+		}
+	}
+	imgs = ai
+
+	if len(imgs) == 0 {
+		return nil, &arcNotFoundError{id: id}
+	}
+	return imgs, nil
+}
+
+// getBestImageByMgidID
+// returns id, crop width, crop height, offset x, offset y, focal point (nil when the image has none)
+func getBestImageByMgidID(id string, pd *parametersData) (string, uint, uint, int, int, *focalPoint, error) {
+	var bestImg image
+	var bestCropSet virtualImageParams
+	var bestCropSetWidth float64
+	var bestCropSetHeight float64
+	var bestImgInitted = false
+	var bestImgRatio float64
+	var ratio float64
+
+	imgs, err := getArcImages(id, pd)
+	if err != nil {
+		return "", 0, 0, 0, 0, nil, err
+	}
+
+	if pd.CW == 0 || pd.CH == 0 {
+		//if neither width or height are provided then grab first image and live with it
+		return imgs[0].ImageAssetRefs[0].URI, 0, 0, 0, 0, validFocalPoint(imgs[0].FocalPoint), nil
+	}
+
+	ratio = math.Floor((float64(pd.CW) / float64(pd.CH)) * 10)
+
+	//now run back through them all and find the image that best fits the requested width and height
+	//if only width or height are specified grab first image that is greater than the provided values
+	pd.log("finding best image...")
+	for i := 0; i < len(imgs); i++ {
+		pd.log("img index: " + intToString(i))
+		if bestImgInitted == false {
+			pd.log("always pick the first image by default")
+			bestImg = imgs[i]
+			bestImgRatio = math.Floor((float64(bestImg.ImageAssetRefs[0].Width) / float64(bestImg.ImageAssetRefs[0].Height)) * 10)
+			bestImgInitted = true
+
+			if len(imgs[i].VirtualImageParams) > 0 {
+				bestCropSet = imgs[i].VirtualImageParams[0]
+				pd.log("best crop called-init: ch=" + uintToString(bestCropSet.CropSizeHeight) + ", cw=" + uintToString(bestCropSet.CropSizeWidth) + ", x=" + intToString(bestCropSet.TopLeftX) + ", y=" + intToString(bestCropSet.TopLeftY))
+				bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+				bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+				bestImgRatio = math.Floor((float64(bestImg.ImageAssetRefs[0].Width) / float64(bestImg.ImageAssetRefs[0].Height)) * 10)
+
+				for j := 0; j < len(bestImg.VirtualImageParams); j++ {
+					newRatio := math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					diffwidth := uintDiff(pd.CW, imgs[i].VirtualImageParams[j].CropSizeWidth)
+					diffHeight := uintDiff(pd.CH, imgs[i].VirtualImageParams[j].CropSizeHeight)
+					pd.log("original ratio: " + floatToString(ratio) + ", new ratio: " + floatToString(newRatio))
+					if newRatio == ratio && (diffwidth < bestCropSetWidth || diffHeight < bestCropSetHeight) {
+						pd.log("picked cropset processing option 1-init")
+						bestCropSet = imgs[i].VirtualImageParams[j]
+						bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+						bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+						bestImgRatio = math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					} else if newRatio == ratio && bestImgRatio != ratio {
+						pd.log("picked cropset processing option 2-init: newRatio=" + floatToString(newRatio) + ", bestImgRatio=" + floatToString(bestImgRatio) + ", ratio=" + floatToString(ratio))
+						bestCropSet = imgs[i].VirtualImageParams[j]
+						bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+						bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+						bestImgRatio = math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					} else if bestImgRatio != ratio && diffwidth < bestCropSetWidth && diffHeight < bestCropSetHeight {
+						pd.log("picked cropset processing option 3-init")
+						bestCropSet = imgs[i].VirtualImageParams[j]
+						bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+						bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+						bestImgRatio = math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					}
+				}
+			}
+		} else {
+			if len(imgs[i].VirtualImageParams) > 0 {
+				bestCropSet = imgs[i].VirtualImageParams[0]
+				pd.log("best crop called: ch=" + uintToString(bestCropSet.CropSizeHeight) + ", cw=" + uintToString(bestCropSet.CropSizeWidth) + ", x=" + intToString(bestCropSet.TopLeftX) + ", y=" + intToString(bestCropSet.TopLeftY))
+				bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+				bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+				bestImgRatio = math.Floor((float64(bestImg.ImageAssetRefs[0].Width) / float64(bestImg.ImageAssetRefs[0].Height)) * 10)
+
+				for j := 0; j < len(bestImg.VirtualImageParams); j++ {
+					newRatio := math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					diffwidth := uintDiff(pd.CW, imgs[i].VirtualImageParams[j].CropSizeWidth)
+					diffHeight := uintDiff(pd.CH, imgs[i].VirtualImageParams[j].CropSizeHeight)
+					pd.log("original ratio: " + floatToString(ratio) + ", new ratio: " + floatToString(newRatio))
+					if newRatio == ratio && (diffwidth < bestCropSetWidth || diffHeight < bestCropSetHeight) {
+						pd.log("picked cropset processing option 1")
+						bestCropSet = imgs[i].VirtualImageParams[j]
+						bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+						bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+						bestImgRatio = math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					} else if newRatio == ratio && bestImgRatio != ratio {
+						pd.log("picked cropset processing option 2: newRatio=" + floatToString(newRatio) + ", bestImgRatio=" + floatToString(bestImgRatio) + ", ratio=" + floatToString(ratio))
+						bestCropSet = imgs[i].VirtualImageParams[j]
+						bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+						bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+						bestImgRatio = math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					} else if bestImgRatio != ratio && diffwidth < bestCropSetWidth && diffHeight < bestCropSetHeight {
+						pd.log("picked cropset processing option 3")
+						bestCropSet = imgs[i].VirtualImageParams[j]
+						bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+						bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+						bestImgRatio = math.Floor((float64(imgs[i].VirtualImageParams[j].CropSizeWidth) / float64(imgs[i].VirtualImageParams[j].CropSizeHeight)) * 10)
+					}
+				}
+			} else {
+				//image has no crop sets
+				newRatio := math.Floor((float64(imgs[i].ImageAssetRefs[0].Width) / float64(imgs[i].ImageAssetRefs[0].Height)) * 10)
+				diffwidth := uintDiff(pd.CW, imgs[i].ImageAssetRefs[0].Width)
+				diffHeight := uintDiff(pd.CH, imgs[i].ImageAssetRefs[0].Height)
+				pd.log("Image has no crop sets newRatio=" + floatToString(newRatio) + ", ratio=" + floatToString(ratio) + ", diffWidth=" + floatToString(diffwidth) + ", bestCropSetWidth=" + floatToString(bestCropSetWidth) + ", diffHeight=" + floatToString(diffHeight) + ", bestCropSetHeight=" + floatToString(bestCropSetHeight))
+				pd.log("checking image asset ref details to check ratio")
+				if newRatio == ratio && (diffwidth < bestCropSetWidth || diffHeight < bestCropSetHeight) {
+					pd.log("processing b-1")
+					bestImg = imgs[i]
+					bestCropSetWidth = uintDiff(pd.CW, bestImg.ImageAssetRefs[0].Width)
+					bestCropSetHeight = uintDiff(pd.CH, bestImg.ImageAssetRefs[0].Height)
+					bestImgRatio = math.Floor((float64(bestImg.ImageAssetRefs[0].Width) / float64(bestImg.ImageAssetRefs[0].Height)) * 10)
+				} else if newRatio == ratio && bestImgRatio != ratio {
+					pd.log("processing option b-2: newRatio=" + floatToString(newRatio) + ", bestImgRatio=" + floatToString(bestImgRatio) + ", ratio=" + floatToString(ratio))
+					bestImg = imgs[i]
+					bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+					bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+					bestImgRatio = math.Floor((float64(bestImg.ImageAssetRefs[0].Width) / float64(bestImg.ImageAssetRefs[0].Height)) * 10)
+				} else if bestImgRatio != ratio && diffwidth < bestCropSetWidth && diffHeight < bestCropSetHeight {
+					pd.log("processing b-3")
+					bestImg = imgs[i]
+					bestCropSetWidth = uintDiff(pd.CW, bestCropSet.CropSizeWidth)
+					bestCropSetHeight = uintDiff(pd.CH, bestCropSet.CropSizeHeight)
+					bestImgRatio = math.Floor((float64(bestImg.ImageAssetRefs[0].Width) / float64(bestImg.ImageAssetRefs[0].Height)) * 10)
+				}
+			}
+		}
+	}
+
+	pd.log("By Id best img uri found was: " + bestImg.ImageAssetRefs[0].URI)
+	if bestCropSet.CropSizeWidth > 0 {
+		pd.log("Best virtual cropset found w:" + uintToString(bestCropSet.CropSizeWidth) + ", h:" + uintToString(bestCropSet.CropSizeHeight) + ", x:" + intToString(bestCropSet.TopLeftX) + ", y:" + intToString(bestCropSet.TopLeftY))
+		return bestImg.ImageAssetRefs[0].URI, bestCropSet.CropSizeWidth, bestCropSet.CropSizeHeight, bestCropSet.TopLeftX, bestCropSet.TopLeftY, validFocalPoint(bestImg.FocalPoint), nil
+	}
+	return bestImg.ImageAssetRefs[0].URI, 0, 0, 0, 0, validFocalPoint(bestImg.FocalPoint), nil
+}
+
+// validFocalPoint returns fp when it lies inside the image otherwise nil
+func validFocalPoint(fp *focalPoint) *focalPoint {
+	if fp == nil || fp.X < 0 || fp.X > 1 || fp.Y < 0 || fp.Y > 1 {
+		return nil
+	}
+	return fp
+}
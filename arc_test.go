@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	redis "gopkg.in/redis.v4"
+)
+
+func readArcFixture(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "arc", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// serveArcFixture points the arc query at a server answering every call with the fixture name
+func serveArcFixture(t *testing.T, name string) func() {
+	b := readArcFixture(t, name)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}))
+	q, rc := imageIDQuery, redisClient
+	imageIDQuery = srv.URL + "/" + imageIDQueryString
+	//nothing listens here so every cache lookup misses and the fixture is fetched
+	redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	return func() {
+		srv.Close()
+		imageIDQuery, redisClient = q, rc
+	}
+}
+
+func decodeArcFixture(t *testing.T, name string) item {
+	var data responseWrapper
+	if err := json.Unmarshal(readArcFixture(t, name), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Response.Docs) != 1 {
+		t.Fatalf("%s has %d docs, want 1", name, len(data.Response.Docs))
+	}
+	var it item
+	if err := json.Unmarshal(data.Response.Docs[0], &it); err != nil {
+		t.Fatal(err)
+	}
+	return it
+}
+
+func TestDecodeArcImage(t *testing.T) {
+	it := decodeArcFixture(t, "image.json")
+
+	want := imageAssetRefs{Format: imageFormat{TypeName: "jpeg"}, Height: 1080, Width: 1920, URI: "mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/ds_21_095_act2.jpg"}
+	if len(it.ImageAssetRefs) != 1 || it.ImageAssetRefs[0] != want {
+		t.Errorf("imageAssetRefs = %+v, want [%+v]", it.ImageAssetRefs, want)
+	}
+	wantCrops := []virtualImageParams{
+		{TopLeftX: 298, TopLeftY: 0, CropSizeWidth: 1323, CropSizeHeight: 744},
+		{TopLeftX: 420, TopLeftY: 0, CropSizeWidth: 1080, CropSizeHeight: 1080},
+	}
+	if len(it.VirtualImageParams) != len(wantCrops) {
+		t.Fatalf("virtualImageParams = %+v, want %+v", it.VirtualImageParams, wantCrops)
+	}
+	for i, c := range wantCrops {
+		if it.VirtualImageParams[i] != c {
+			t.Errorf("virtualImageParams[%d] = %+v, want %+v", i, it.VirtualImageParams[i], c)
+		}
+	}
+	if it.FocalPoint == nil || *it.FocalPoint != (focalPoint{X: 0.5, Y: 0.4}) {
+		t.Errorf("focalPoint = %+v, want {X:0.5 Y:0.4}", it.FocalPoint)
+	}
+	if len(it.Images) != 0 || len(it.ImagesWithCaptions) != 0 {
+		t.Errorf("image object has nested images %+v %+v", it.Images, it.ImagesWithCaptions)
+	}
+}
+
+func TestDecodeArcItem(t *testing.T) {
+	it := decodeArcFixture(t, "item.json")
+
+	if len(it.ImageAssetRefs) != 0 {
+		t.Errorf("item has imageAssetRefs %+v", it.ImageAssetRefs)
+	}
+	if len(it.ImagesWithCaptions) != 1 {
+		t.Fatalf("ImagesWithCaptions = %+v, want 1", it.ImagesWithCaptions)
+	}
+	ci := it.ImagesWithCaptions[0].Image
+	if len(ci.ImageAssetRefs) != 1 || ci.ImageAssetRefs[0].URI != "mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/captioned.jpg" || ci.ImageAssetRefs[0].Width != 1280 || ci.ImageAssetRefs[0].Height != 720 {
+		t.Errorf("captioned imageAssetRefs = %+v", ci.ImageAssetRefs)
+	}
+	if len(ci.VirtualImageParams) != 2 || ci.VirtualImageParams[1] != (virtualImageParams{TopLeftX: 280, CropSizeWidth: 720, CropSizeHeight: 720}) {
+		t.Errorf("captioned virtualImageParams = %+v", ci.VirtualImageParams)
+	}
+	if ci.FocalPoint == nil || *ci.FocalPoint != (focalPoint{X: 0.25, Y: 0.5}) {
+		t.Errorf("captioned focalPoint = %+v, want {X:0.25 Y:0.5}", ci.FocalPoint)
+	}
+
+	if len(it.Images) != 2 {
+		t.Fatalf("Images = %+v, want 2", it.Images)
+	}
+	if len(it.Images[0].ImageAssetRefs) != 1 || it.Images[0].ImageAssetRefs[0].Format.TypeName != "png" || it.Images[0].FocalPoint != nil {
+		t.Errorf("Images[0] = %+v", it.Images[0])
+	}
+	if len(it.Images[1].ImageAssetRefs) != 0 {
+		t.Errorf("Images[1] = %+v, want no assets", it.Images[1])
+	}
+}
+
+func TestGetBestImageByMgidID(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		cw, ch  uint
+		id      string
+		crop    virtualImageParams
+		fp      *focalPoint
+	}{
+		{
+			name:    "image object without a crop size takes the first asset",
+			fixture: "image.json",
+			id:      "mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/ds_21_095_act2.jpg",
+			fp:      &focalPoint{X: 0.5, Y: 0.4},
+		},
+		{
+			name:    "image object picks the crop set of the same shape",
+			fixture: "image.json",
+			cw:      1000,
+			ch:      1000,
+			id:      "mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/ds_21_095_act2.jpg",
+			crop:    virtualImageParams{TopLeftX: 420, CropSizeWidth: 1080, CropSizeHeight: 1080},
+			fp:      &focalPoint{X: 0.5, Y: 0.4},
+		},
+		{
+			name:    "item picks the captioned image crop set nearest the crop size",
+			fixture: "item.json",
+			cw:      700,
+			ch:      700,
+			id:      "mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/captioned.jpg",
+			crop:    virtualImageParams{TopLeftX: 280, CropSizeWidth: 720, CropSizeHeight: 720},
+			fp:      &focalPoint{X: 0.25, Y: 0.5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer serveArcFixture(t, tt.fixture)()
+			var pd parametersData
+			pd.CW, pd.CH = tt.cw, tt.ch
+
+			id, cw, ch, cx, cy, fp, err := getBestImageByMgidID("mgid:arc:video:comedycentral.com:2b469942-7bba-4d3a-9393-e9355f710d2c", &pd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.id {
+				t.Errorf("id = %s, want %s", id, tt.id)
+			}
+			if got := (virtualImageParams{TopLeftX: cx, TopLeftY: cy, CropSizeWidth: cw, CropSizeHeight: ch}); got != tt.crop {
+				t.Errorf("crop = %+v, want %+v", got, tt.crop)
+			}
+			if fp == nil || *fp != *tt.fp {
+				t.Errorf("focal point = %+v, want %+v", fp, tt.fp)
+			}
+		})
+	}
+}
+
+func TestGetBestImageByMgidIDErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		id      string
+		check   func(error) bool
+	}{
+		{
+			name:    "malformed json",
+			fixture: "malformed.json",
+			id:      "mgid:arc:video:comedycentral.com:2b469942-7bba-4d3a-9393-e9355f710d2c",
+			check:   func(err error) bool { _, ok := err.(*arcDecodeError); return ok },
+		},
+		{
+			name:    "doc of the wrong shape",
+			fixture: "wrongtype.json",
+			id:      "mgid:arc:video:comedycentral.com:2b469942-7bba-4d3a-9393-e9355f710d2c",
+			check:   func(err error) bool { _, ok := err.(*arcDecodeError); return ok },
+		},
+		{
+			name:    "no docs",
+			fixture: "empty.json",
+			id:      "mgid:arc:video:comedycentral.com:2b469942-7bba-4d3a-9393-e9355f710d2c",
+			check:   func(err error) bool { _, ok := err.(*arcNotFoundError); return ok },
+		},
+		{
+			name:    "short mgid",
+			fixture: "image.json",
+			id:      "mgid:arc:video:comedycentral.com",
+			check:   func(err error) bool { _, ok := err.(*invalidMgidError); return ok },
+		},
+		{
+			name:    "other provider",
+			fixture: "image.json",
+			id:      "mgid:file:video:comedycentral.com:2b469942-7bba-4d3a-9393-e9355f710d2c",
+			check:   func(err error) bool { _, ok := err.(*invalidMgidError); return ok },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer serveArcFixture(t, tt.fixture)()
+			var pd parametersData
+			pd.CW, pd.CH = 700, 700
+
+			id, _, _, _, _, fp, err := getBestImageByMgidID(tt.id, &pd)
+			if !tt.check(err) {
+				t.Fatalf("err = %T %v", err, err)
+			}
+			if id != "" || fp != nil {
+				t.Errorf("fell back to id %q focal point %+v", id, fp)
+			}
+		})
+	}
+}
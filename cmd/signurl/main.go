@@ -0,0 +1,39 @@
+// Command signurl mints signed image server urls.
+//
+// Usage:
+// signurl [-secret secret] [-prefix /uri/] [-host http://localhost:8080] {parameters} {image mgid string}
+//
+// Parameters are signed exactly as they appear in the url so url encode values such as txt first.
+// The secret defaults to the URL_SIGNING_SECRET environment variable used by the image server.
+// Example:
+// signurl -host http://localhost:8080 rw=480:rh=320:q=50 mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/videos/season_21/21095/ds_21_095_act2.jpg
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jsaterfiel/go-imagick/signature"
+)
+
+func main() {
+	secret := flag.String("secret", os.Getenv("URL_SIGNING_SECRET"), "signing secret shared with the image server")
+	prefix := flag.String("prefix", "/uri/", "route prefix, /uri/, /oid/, /img/, /manifest/ or /info/ which takes \"\" for the parameters")
+	host := flag.String("host", "", "optional scheme and host to put in front of the path")
+	flag.Parse()
+
+	if *secret == "" {
+		fmt.Println("Missing signing secret, pass -secret or set the environment variable URL_SIGNING_SECRET")
+		os.Exit(1)
+	}
+	if flag.NArg() != 2 {
+		fmt.Println("Usage: signurl [-secret secret] [-prefix /uri/] [-host url] {parameters} {image mgid string}")
+		os.Exit(1)
+	}
+
+	//the route is signed so a url can't be moved to another route
+	route := strings.Trim(*prefix, "/")
+	fmt.Println(*host + signature.Path([]byte(*secret), route, flag.Arg(0), flag.Arg(1)))
+}
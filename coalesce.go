@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	redis "gopkg.in/redis.v4"
+)
+
+// how long to wait for another instance holding the fetch lock before giving up, 0 disables waiting
+var lockWaitTimeout = imageFetchTimeout
+
+// how often the local volume and lock are checked while waiting on another instance
+const lockWaitInterval = time.Duration(100) * time.Millisecond
+
+// imageCall is an in flight generateImage shared by concurrent identical requests
+type imageCall struct {
+	//closed once the result is set
+	done chan struct{}
+	ctx  context.Context
+	i    []byte
+	f    string
+	err  error
+}
+
+// imageGroup deduplicates concurrent identical image generation within this instance
+type imageGroup struct {
+	mu    sync.Mutex
+	calls map[string]*imageCall
+}
+
+var imageCalls = &imageGroup{calls: make(map[string]*imageCall)}
+
+// do runs fn once for all concurrent callers with the same key and hands every caller the result.
+// ctx is the context fn runs under, callers that waited on a call whose ctx was cancelled run fn themselves.
+// A caller stops waiting with ctx's error as soon as its own ctx is done.
+// The returned bool is true when the result came from another caller.
+func (g *imageGroup) do(ctx context.Context, key string, fn func() ([]byte, string, error)) ([]byte, string, bool, error) {
+	for {
+		g.mu.Lock()
+		if c, ok := g.calls[key]; ok {
+			g.mu.Unlock()
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return nil, "", false, ctx.Err()
+			}
+			if c.ctx.Err() != nil && ctx.Err() == nil {
+				//the client that ran the call went away before it finished so try again
+				continue
+			}
+			return c.i, c.f, true, c.err
+		}
+		c := &imageCall{done: make(chan struct{}), ctx: ctx}
+		g.calls[key] = c
+		g.mu.Unlock()
+
+		g.call(c, key, fn)
+		return c.i, c.f, false, c.err
+	}
+}
+
+// call runs fn for c then removes c and wakes its waiters even when fn panics
+func (g *imageGroup) call(c *imageCall, key string, fn func() ([]byte, string, error)) {
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	//waiters get this if fn panics
+	c.err = newImageError(errKindProcessing, "Image generation failed", nil)
+	c.i, c.f, c.err = fn()
+}
+
+// deletes the lock in KEYS[1] only while it still holds the token ARGV[1],
+// so a lock that expired and was taken by another instance is left alone
+var releaseLockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// releaseImageFetchLock lets instances waiting on the image at path p carry on once it is saved.
+// tok is the token setImageFetchLock took the lock with.
+func releaseImageFetchLock(p string, tok string, pd *parametersData) {
+	k := redisKeyLockPrefix + p
+	if err := releaseLockScript.Run(redisClient, []string{k}, tok).Err(); err != nil {
+		fmt.Println("Unable to delete the key: ", k, err)
+		pd.log("Unable to delete the key: " + k + "; ERROR: " + err.Error())
+	}
+}
+
+// waitForImageFetch waits for the instance holding the fetch lock for the local path fp to save the image.
+// If the lock is released or expires without the image showing up this instance fetches the image itself.
+// id is the origin key and p the relative local path as passed to fetchRemoteImageURL
+func waitForImageFetch(id string, p string, fp string, pd *parametersData) ([]byte, error) {
+	if lockWaitTimeout <= 0 {
+		return nil, newImageError(errKindOrigin, "Image is being fetched by another server", nil)
+	}
+	pd.log("Waiting on another server fetching: " + fp)
+
+	ctx := pd.context()
+	deadline := time.Now().Add(lockWaitTimeout)
+	t := time.NewTicker(lockWaitInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, toImageError(ctx.Err())
+		case <-t.C:
+		}
+
+		if i, err := ioutil.ReadFile(fp); err == nil {
+			pd.log("Found image locally after waiting: " + fp)
+			return i, nil
+		}
+		if tok, ok := setImageFetchLock(fp, pd); ok {
+			pd.log("Fetch lock released without the image, fetching: " + fp)
+			i, err := fetchRemoteImageURL(id, p, pd)
+			releaseImageFetchLock(fp, tok, pd)
+			return i, err
+		}
+		if time.Now().After(deadline) {
+			fmt.Println("Timed out waiting on another server fetching: ", fp)
+			pd.log("Timed out waiting on another server fetching: " + fp)
+			return nil, newImageError(errKindOrigin, "Timed out waiting for the image to be fetched", nil)
+		}
+	}
+}
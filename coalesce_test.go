@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestImageGroupPanic(t *testing.T) {
+	g := &imageGroup{calls: make(map[string]*imageCall)}
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		defer func() { recover() }()
+		g.do(context.Background(), "k", func() ([]byte, string, error) {
+			close(started)
+			<-release
+			panic("generate")
+		})
+	}()
+	<-started
+
+	res := make(chan error, 1)
+	go func() {
+		_, _, shared, err := g.do(context.Background(), "k", func() ([]byte, string, error) {
+			return []byte("i"), "jpg", nil
+		})
+		if !shared {
+			err = nil
+		}
+		res <- err
+	}()
+	//let the second caller start waiting on the first
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-res:
+		if err == nil {
+			t.Error("waiter on a panicked call got no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter on a panicked call hung")
+	}
+
+	i, _, shared, err := g.do(context.Background(), "k", func() ([]byte, string, error) {
+		return []byte("i"), "jpg", nil
+	})
+	if err != nil || shared || string(i) != "i" {
+		t.Errorf("call after a panic = %q, %v, %v", i, shared, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"strings"
+
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// longest side the image is shrunk to before scoring crop windows for the smart gravities
+const smartCropSize = 256
+
+// number of steps scored along each axis the crop window can move
+const smartCropSteps = 8
+
+// smartGravity reports whether the gravity g looks at the image content
+func smartGravity(g string) bool {
+	return g == "entropy" || g == "attention"
+}
+
+// cropOffset returns the top left offset of a cw by ch crop of the current frame of mw for the gravity g
+func cropOffset(mw *imagick.MagickWand, cw uint, ch uint, g string, pd *parametersData) (int, int) {
+	if smartGravity(g) {
+		return smartCropOffset(mw, cw, ch, g, pd)
+	}
+
+	return gravityOffset(int(mw.GetImageWidth())-int(cw), int(mw.GetImageHeight())-int(ch), g)
+}
+
+// gravityOffset returns the offset for the compass gravity g when there are dx and dy pixels to spare
+func gravityOffset(dx int, dy int, g string) (int, int) {
+	x, y := dx/2, dy/2
+	if g == "center" {
+		return x, y
+	}
+	if strings.Contains(g, "n") {
+		y = 0
+	}
+	if strings.Contains(g, "s") {
+		y = dy
+	}
+	if strings.Contains(g, "w") {
+		x = 0
+	}
+	if strings.Contains(g, "e") {
+		x = dx
+	}
+	return x, y
+}
+
+// focalOffset returns the top left offset of a cw by ch crop of a w by h frame
+// centered on the focal point fx, fy as near as the frame allows
+func focalOffset(w uint, h uint, cw uint, ch uint, fx float64, fy float64) (int, int) {
+	x := int(fx*float64(w)+0.5) - int(cw)/2
+	y := int(fy*float64(h)+0.5) - int(ch)/2
+	return clampInt(x, 0, int(w)-int(cw)), clampInt(y, 0, int(h)-int(ch))
+}
+
+// smartCropOffset scores crop windows across a shrunk copy of the current frame of mw returning the offset of the best one.
+// entropy keeps the busiest region while attention keeps the region with the strongest edges.
+func smartCropOffset(mw *imagick.MagickWand, cw uint, ch uint, g string, pd *parametersData) (int, int) {
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
+	if cw >= w && ch >= h {
+		return 0, 0
+	}
+
+	s := math.Min(1, float64(smartCropSize)/math.Max(float64(w), float64(h)))
+	sw := mw.GetImage()
+	defer sw.Destroy()
+	sw.ThumbnailImage(scaleDim(w, s), scaleDim(h, s))
+	sw.TransformImageColorspace(imagick.COLORSPACE_GRAY)
+	if g == "attention" {
+		sw.EdgeImage(1)
+	}
+
+	tw := sw.GetImageWidth()
+	th := sw.GetImageHeight()
+	scw := scaleDim(cw, s)
+	sch := scaleDim(ch, s)
+	if scw > tw {
+		scw = tw
+	}
+	if sch > th {
+		sch = th
+	}
+
+	px, err := sw.ExportImagePixels(0, 0, tw, th, "I", imagick.PIXEL_CHAR)
+	if err != nil {
+		pd.log("Smart crop " + g + " failed, cropping from the center: " + err.Error())
+		return cropOffset(mw, cw, ch, "center", pd)
+	}
+	gray := px.([]byte)
+
+	best := -1.0
+	bx, by := 0, 0
+	for _, y := range cropSteps(int(th) - int(sch)) {
+		for _, x := range cropSteps(int(tw) - int(scw)) {
+			score := windowScore(gray, int(tw), x, y, int(scw), int(sch), g)
+			if score > best {
+				best = score
+				bx, by = x, y
+			}
+		}
+	}
+
+	//scale back up and keep the window inside the frame
+	x := clampInt(int(float64(bx)/s+0.5), 0, int(w)-int(cw))
+	y := clampInt(int(float64(by)/s+0.5), 0, int(h)-int(ch))
+	pd.log("Smart crop " + g + " picked x=" + intToString(x) + ", y=" + intToString(y))
+	return x, y
+}
+
+// windowScore scores the cw by ch window at x, y of the gray pixels of a frame stride pixels wide.
+// attention uses the mean edge strength and entropy the shannon entropy of the window's histogram.
+func windowScore(gray []byte, stride int, x int, y int, cw int, ch int, g string) float64 {
+	var hist [256]int
+	for r := y; r < y+ch; r++ {
+		for _, v := range gray[r*stride+x : r*stride+x+cw] {
+			hist[v]++
+		}
+	}
+	n := float64(cw * ch)
+	if n == 0 {
+		return 0
+	}
+
+	score := 0.0
+	for v, c := range hist {
+		if c == 0 {
+			continue
+		}
+		if g == "attention" {
+			score += float64(v*c) / n
+		} else {
+			p := float64(c) / n
+			score -= p * math.Log2(p)
+		}
+	}
+	return score
+}
+
+// cropSteps spreads the offsets to score evenly across the d pixels a window can move
+func cropSteps(d int) []int {
+	if d <= 0 {
+		return []int{0}
+	}
+	n := smartCropSteps
+	if d < n {
+		n = d
+	}
+	steps := make([]int, 0, n+1)
+	for i := 0; i <= n; i++ {
+		steps = append(steps, d*i/n)
+	}
+	return steps
+}
+
+func clampInt(v int, min int, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestWindowScore(t *testing.T) {
+	//4x2 frame, the left half flat black and the right half a black and white checker
+	gray := []byte{
+		0, 0, 0, 255,
+		0, 0, 255, 0,
+	}
+	tests := []struct {
+		x    int
+		g    string
+		want float64
+	}{
+		{0, "entropy", 0},
+		{2, "entropy", 1},
+		{0, "attention", 0},
+		{2, "attention", 127.5},
+	}
+	for _, tt := range tests {
+		if got := windowScore(gray, 4, tt.x, 0, 2, 2, tt.g); got != tt.want {
+			t.Errorf("windowScore(x=%d, %s) = %v, want %v", tt.x, tt.g, got, tt.want)
+		}
+	}
+}
+
+func TestCropSteps(t *testing.T) {
+	tests := []struct {
+		d    int
+		want []int
+	}{
+		{-5, []int{0}},
+		{0, []int{0}},
+		{3, []int{0, 1, 2, 3}},
+		{16, []int{0, 2, 4, 6, 8, 10, 12, 14, 16}},
+	}
+	for _, tt := range tests {
+		got := cropSteps(tt.d)
+		if len(got) != len(tt.want) {
+			t.Errorf("cropSteps(%d) = %v, want %v", tt.d, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("cropSteps(%d) = %v, want %v", tt.d, got, tt.want)
+				break
+			}
+		}
+	}
+}
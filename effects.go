@@ -0,0 +1,52 @@
+package main
+
+import (
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// hasEffects reports whether any effect parameter was given
+func (pd *parametersData) hasEffects() bool {
+	return pd.Bri != 0 || pd.Con != 0 || pd.Sat != 0 || pd.Hue != 0 || pd.Gray || pd.Sepia > 0 || pd.Blur > 0 || pd.Sharp > 0
+}
+
+// applyEffects runs the effects on the current frame of mw in a fixed order whatever order the parameters came in.
+// Color adjustments go first, then the color tones and finally blur and sharpen.
+func applyEffects(mw *imagick.MagickWand, pd *parametersData) error {
+	if pd.Bri != 0 || pd.Con != 0 {
+		if err := mw.BrightnessContrastImage(pd.Bri, pd.Con); err != nil {
+			return err
+		}
+	}
+	if pd.Sat != 0 || pd.Hue != 0 {
+		//modulate works in percent where 100 is no change and hue wraps at 0 and 200
+		if err := mw.ModulateImage(100, 100+pd.Sat, 100+pd.Hue*100/180); err != nil {
+			return err
+		}
+	}
+	if pd.Gray {
+		if err := mw.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+			return err
+		}
+		//back to srgb so the later effects and encoders see color channels
+		if err := mw.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+			return err
+		}
+	}
+	if pd.Sepia > 0 {
+		_, qr := imagick.GetQuantumRange()
+		if err := mw.SepiaToneImage(pd.Sepia * float64(qr) / 100); err != nil {
+			return err
+		}
+	}
+	if pd.Blur > 0 {
+		if err := mw.BlurImage(0, pd.Blur); err != nil {
+			return err
+		}
+	}
+	if pd.Sharp > 0 {
+		if err := mw.SharpenImage(0, pd.Sharp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// errorKind classifies failures in the image request path so handlers can pick the response status
+type errorKind int
+
+const (
+	//the requested image or object doesn't exist
+	errKindNotFound errorKind = iota
+	//the origin or arc could not be reached or returned something unusable
+	errKindOrigin
+	//the request path or parameters are invalid
+	errKindBadParams
+	//imagemagick or the local volume failed while building the image
+	errKindProcessing
+)
+
+// imageError is returned from the image request path.
+// msg is safe to show to clients while err holds the underlying details for the logs.
+type imageError struct {
+	kind errorKind
+	msg  string
+	err  error
+}
+
+func (e *imageError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+// status is the http status code sent for the error
+func (e *imageError) status() int {
+	switch e.kind {
+	case errKindNotFound:
+		return http.StatusNotFound
+	case errKindOrigin:
+		return http.StatusBadGateway
+	case errKindBadParams:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// fallback reports whether the default image should be served along with the error status
+func (e *imageError) fallback() bool {
+	return e.kind == errKindNotFound || e.kind == errKindOrigin
+}
+
+func newImageError(kind errorKind, msg string, err error) *imageError {
+	return &imageError{kind: kind, msg: msg, err: err}
+}
+
+// toImageError classifies errors from the origins and arc
+func toImageError(err error) *imageError {
+	switch e := err.(type) {
+	case *imageError:
+		return e
+	case *invalidMgidError:
+		return newImageError(errKindBadParams, "Invalid mgid", err)
+	case *arcNotFoundError:
+		return newImageError(errKindNotFound, "Image not found", err)
+	case *arcDecodeError, *arcFetchError:
+		return newImageError(errKindOrigin, "Failed to fetch image object", err)
+	case *httpStatusError:
+		if e.code == http.StatusNotFound || e.code == http.StatusGone {
+			return newImageError(errKindNotFound, "Image not found", err)
+		}
+	case awserr.Error:
+		if e.Code() == "NoSuchKey" {
+			return newImageError(errKindNotFound, "Image not found", err)
+		}
+	}
+	if os.IsNotExist(err) {
+		return newImageError(errKindNotFound, "Image not found", err)
+	}
+	return newImageError(errKindOrigin, "Failed to fetch image", err)
+}
+
+// writeError sends the error status with a plain text body
+func writeError(w http.ResponseWriter, err error) {
+	ie := toImageError(err)
+	http.Error(w, http.StatusText(ie.status())+": "+ie.msg, ie.status())
+}
+
+// writeRequestError sends the debug output with the error status in debug mode otherwise the error
+func writeRequestError(w http.ResponseWriter, pd *parametersData, err error) {
+	if pd.debug {
+		outputDebug(w, pd, toImageError(err).status())
+		return
+	}
+	writeError(w, err)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jsaterfiel/go-imagick/transform"
+)
+
+// formats picked from the accept header in order of preference when f is not requested,
+// set with NEGOTIATE_FORMATS for imagemagick builds without the avif delegate
+var negotiateFormats = []string{"avif", "webp"}
+
+// formats that can hold every frame of an animated gif
+var animatedFormats = map[string]bool{
+	"gif":  true,
+	"webp": true,
+}
+
+// initFormats reads the negotiated formats from the environment variable
+// NEGOTIATE_FORMATS - comma separated formats in order of preference, defaults to avif,webp
+func initFormats() error {
+	v := os.Getenv("NEGOTIATE_FORMATS")
+	if v == "" {
+		return nil
+	}
+	negotiateFormats = nil
+	for _, s := range strings.Split(v, ",") {
+		var t transform.Transform
+		if err := t.Parse("f=" + strings.TrimSpace(s)); err != nil {
+			return fmt.Errorf("Invalid environment variable NEGOTIATE_FORMATS %s, %s", v, err)
+		}
+		negotiateFormats = append(negotiateFormats, t.F)
+	}
+	return nil
+}
+
+// negotiateFormat returns the output format from the requested format f or the header accept string ha.
+// The accepted format with the highest q value wins with ties going to the earlier of negotiateFormats.
+// An empty result means the format depends on the source image and is picked in getImageFormat.
+func negotiateFormat(f string, ha string) string {
+	if f != "" {
+		return strings.ToLower(f)
+	}
+	var of string
+	var bq float64
+	for _, v := range negotiateFormats {
+		q := acceptQuality(ha, "image/"+v)
+		if q > bq {
+			of = v
+			bq = q
+		}
+	}
+	return of
+}
+
+// animatedFallback returns the format used for animated sources when the negotiated format can't hold the frames.
+// It depends on the accept header ha so it is part of the cache key along with the negotiated format.
+func animatedFallback(ha string) string {
+	if acceptQuality(ha, "image/webp") > 0 {
+		return "webp"
+	}
+	return "gif"
+}
+
+// acceptQuality returns the q value the accept header ha gives the media type mt.
+// Only an exact match counts as wildcards like image/* are sent by browsers that can't decode avif.
+func acceptQuality(ha string, mt string) float64 {
+	for _, v := range strings.Split(ha, ",") {
+		ps := strings.Split(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(ps[0]), mt) {
+			continue
+		}
+		q := 1.0
+		for _, p := range ps[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			pq, err := strconv.ParseFloat(p[2:], 64)
+			if err == nil && pq >= 0 && pq <= 1 {
+				q = pq
+			}
+		}
+		return q
+	}
+	return 0
+}
+
+// formatQuality maps the jpeg scale quality q onto the encoder setting of format f giving about the same visual quality.
+// avif holds up at much lower settings than jpeg while jxl was designed around the jpeg scale.
+func formatQuality(f string, q uint) uint {
+	switch f {
+	case "avif":
+		aq := q * 3 / 4
+		if aq < 1 {
+			aq = 1
+		}
+		return aq
+	}
+	return q
+}
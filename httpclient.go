@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// shared client for the http origin and the arc object calls, set up by initHTTPClient
+var httpClient = http.DefaultClient
+
+// number of extra attempts made after a connection error or 5xx response
+var httpRetries = 2
+
+// wait before the first retry, doubled for every retry after that
+var httpRetryBackoff = time.Duration(200) * time.Millisecond
+
+// httpStatusError is returned for non 2xx responses
+type httpStatusError struct {
+	url  string
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return "unexpected status " + strconv.Itoa(e.code) + " for url: " + e.url
+}
+
+// initHTTPClient builds the shared client from the environment variables
+// HTTP_TIMEOUT - overall time for a single attempt including reading the body, defaults to 10s
+// HTTP_CONNECT_TIMEOUT - time to establish a connection, defaults to 2s
+// HTTP_RETRIES - extra attempts on connection errors and 5xx responses, defaults to 2
+// HTTP_RETRY_BACKOFF - wait before the first retry which doubles per retry, defaults to 200ms
+func initHTTPClient() error {
+	t, err := envDuration("HTTP_TIMEOUT", time.Duration(10)*time.Second)
+	if err != nil {
+		return err
+	}
+	ct, err := envDuration("HTTP_CONNECT_TIMEOUT", time.Duration(2)*time.Second)
+	if err != nil {
+		return err
+	}
+	httpRetryBackoff, err = envDuration("HTTP_RETRY_BACKOFF", httpRetryBackoff)
+	if err != nil {
+		return err
+	}
+	if v := os.Getenv("HTTP_RETRIES"); v != "" {
+		httpRetries, err = strconv.Atoi(v)
+		if err != nil || httpRetries < 0 {
+			return fmt.Errorf("Invalid environment variable HTTP_RETRIES %s, must be a positive number", v)
+		}
+	}
+
+	httpClient = &http.Client{
+		Timeout: t,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   ct,
+				KeepAlive: time.Duration(30) * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   ct,
+			ResponseHeaderTimeout: t,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       time.Duration(90) * time.Second,
+		},
+	}
+	return nil
+}
+
+// fetchBudget is the longest httpGet can take, every attempt timing out plus the backoff between them
+func fetchBudget() time.Duration {
+	d := httpClient.Timeout * time.Duration(httpRetries+1)
+	b := httpRetryBackoff
+	for a := 0; a < httpRetries; a++ {
+		d += b
+		b *= 2
+	}
+	return d
+}
+
+func envDuration(name string, d time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return d, nil
+	}
+	ed, err := time.ParseDuration(v)
+	if err != nil {
+		return d, fmt.Errorf("Invalid environment variable %s %s, must be a duration like 5s", name, v)
+	}
+	return ed, nil
+}
+
+// httpGet fetches u with the shared client retrying connection errors and 5xx responses.
+// Only 2xx responses are returned, anything else is an *httpStatusError.
+// Retries stop as soon as ctx is done such as when the client disconnects.
+func httpGet(ctx context.Context, u string) ([]byte, http.Header, error) {
+	var err error
+	backoff := httpRetryBackoff
+	for a := 0; a <= httpRetries; a++ {
+		if a > 0 {
+			fmt.Println("Retrying url in ", backoff, ": ", u)
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var b []byte
+		var h http.Header
+		b, h, err = httpGetOnce(ctx, u)
+		if err == nil {
+			return b, h, nil
+		}
+		fmt.Println("Failed http fetch: ", err)
+
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if se, ok := err.(*httpStatusError); ok && se.code < 500 {
+			//client errors won't get better by trying again
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
+}
+
+func httpGetOnce(ctx context.Context, u string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		//drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		return nil, nil, &httpStatusError{url: u, code: resp.StatusCode}
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, resp.Header, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jsaterfiel/go-imagick/transform"
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// exif tags returned by /info/
+var infoExifTags = []string{
+	"Make",
+	"Model",
+	"LensModel",
+	"DateTimeOriginal",
+	"Orientation",
+	"ExposureTime",
+	"FNumber",
+	"ISOSpeedRatings",
+	"FocalLength",
+	"Artist",
+	"Copyright",
+	"ImageDescription",
+}
+
+// names of the colorspaces reported by /info/
+var colorspaceNames = map[imagick.ColorspaceType]string{
+	imagick.COLORSPACE_SRGB: "srgb",
+	imagick.COLORSPACE_RGB:  "rgb",
+	imagick.COLORSPACE_GRAY: "gray",
+	imagick.COLORSPACE_CMYK: "cmyk",
+}
+
+// imageInfo describes a source image as it is stored without any transform
+type imageInfo struct {
+	//image mgid, for arc mgids the image picked from the object
+	ID         string            `json:"id"`
+	Width      uint              `json:"width"`
+	Height     uint              `json:"height"`
+	Format     string            `json:"format"`
+	Frames     uint              `json:"frames"`
+	Alpha      bool              `json:"alpha"`
+	Colorspace string            `json:"colorspace"`
+	Size       int               `json:"size"`
+	Exif       map[string]string `json:"exif,omitempty"`
+	//crop sets and focal point arc gives the image, /oid/ picks from the same crop sets
+	Crops      []infoCrop  `json:"crops,omitempty"`
+	FocalPoint *focalPoint `json:"focalPoint,omitempty"`
+}
+
+type infoCrop struct {
+	Width  uint `json:"width"`
+	Height uint `json:"height"`
+	X      int  `json:"x"`
+	Y      int  `json:"y"`
+}
+
+// handlerInfo serves /info/{mgid} describing the source image so it can be checked before publishing.
+// Arc mgids are looked up like /oid/ and include all the crop sets of the image.
+// When URL_SIGNING_SECRET is set the path needs a signature made for the info route, /info/sig={signature}/{mgid}
+func handlerInfo(w http.ResponseWriter, r *http.Request) {
+	var pd parametersData
+	pd.ctx = r.Context()
+	_, pd.debug = r.URL.Query()["debug"]
+
+	po := strings.TrimPrefix(r.URL.EscapedPath(), "/info/")
+	if !verifySignature("info", po, &pd) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	rt := routeURI
+	if strings.Contains(po, "mgid:arc:") {
+		rt = routeOID
+	}
+	id, err := parseImagePath(po, rt, &pd)
+	if err != nil {
+		writeRequestError(w, &pd, err)
+		return
+	}
+	if pd.Transform != (transform.Transform{}) {
+		writeRequestError(w, &pd, newImageError(errKindBadParams, "Info doesn't take parameters", nil))
+		return
+	}
+
+	info := imageInfo{ID: id}
+	if rt == routeOID {
+		info.ID, info.Crops, info.FocalPoint, err = arcInfo(id, &pd)
+		if err != nil {
+			writeRequestError(w, &pd, err)
+			return
+		}
+	}
+
+	i, _, err := loadImage(info.ID, &pd)
+	if err != nil {
+		writeRequestError(w, &pd, err)
+		return
+	}
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := mw.ReadImageBlob(i); err != nil {
+		writeRequestError(w, &pd, newImageError(errKindProcessing, "Failed to read image", err))
+		return
+	}
+	mw.SetFirstIterator()
+
+	info.Width = mw.GetImageWidth()
+	info.Height = mw.GetImageHeight()
+	info.Format = strings.ToLower(mw.GetImageFormat())
+	info.Frames = mw.GetNumberImages()
+	info.Alpha = mw.GetImageAlphaChannel()
+	info.Size = len(i)
+	cs := mw.GetImageColorspace()
+	info.Colorspace = colorspaceNames[cs]
+	if info.Colorspace == "" {
+		info.Colorspace = strconv.Itoa(int(cs))
+	}
+	for _, t := range infoExifTags {
+		if v := strings.TrimSpace(mw.GetImageProperty("exif:" + t)); v != "" {
+			if info.Exif == nil {
+				info.Exif = make(map[string]string)
+			}
+			info.Exif[t] = v
+		}
+	}
+
+	writeJSON(w, info)
+}
+
+// arcInfo looks up the arc object mgid id returning the image /oid/ serves when no crop size is asked for
+// along with every crop set and the focal point arc has for that image
+func arcInfo(id string, pd *parametersData) (string, []infoCrop, *focalPoint, error) {
+	imgs, err := getArcImages(id, pd)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	img := imgs[0]
+	var cs []infoCrop
+	for _, v := range img.VirtualImageParams {
+		cs = append(cs, infoCrop{Width: v.CropSizeWidth, Height: v.CropSizeHeight, X: v.TopLeftX, Y: v.TopLeftY})
+	}
+	return img.ImageAssetRefs[0].URI, cs, validFocalPoint(img.FocalPoint), nil
+}
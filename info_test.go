@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestArcInfo(t *testing.T) {
+	tests := []struct {
+		fixture string
+		id      string
+		crops   []infoCrop
+		fp      focalPoint
+	}{
+		{
+			fixture: "image.json",
+			id:      "mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/ds_21_095_act2.jpg",
+			crops:   []infoCrop{{Width: 1323, Height: 744, X: 298}, {Width: 1080, Height: 1080, X: 420}},
+			fp:      focalPoint{X: 0.5, Y: 0.4},
+		},
+		{
+			fixture: "item.json",
+			id:      "mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/captioned.jpg",
+			crops:   []infoCrop{{Width: 1280, Height: 720}, {Width: 720, Height: 720, X: 280}},
+			fp:      focalPoint{X: 0.25, Y: 0.5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			defer serveArcFixture(t, tt.fixture)()
+			var pd parametersData
+
+			id, crops, fp, err := arcInfo("mgid:arc:video:comedycentral.com:2b469942-7bba-4d3a-9393-e9355f710d2c", &pd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.id {
+				t.Errorf("id = %s, want %s", id, tt.id)
+			}
+			if len(crops) != len(tt.crops) {
+				t.Fatalf("crops = %+v, want %+v", crops, tt.crops)
+			}
+			for i, c := range tt.crops {
+				if crops[i] != c {
+					t.Errorf("crops[%d] = %+v, want %+v", i, crops[i], c)
+				}
+			}
+			if fp == nil || *fp != tt.fp {
+				t.Errorf("focal point = %+v, want %+v", fp, tt.fp)
+			}
+		})
+	}
+}
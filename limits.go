@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// largest output width in pixels, set with MAX_WIDTH
+var maxWidth uint = 4096
+
+// largest output height in pixels, set with MAX_HEIGHT
+var maxHeight uint = 4096
+
+// largest output area in megapixels, set with MAX_MEGAPIXELS
+var maxMegapixels = 16.0
+
+// clamp oversize requests down to the limits instead of rejecting them, set with MAX_SIZE_MODE=clamp
+var clampOversize = false
+
+// initLimits reads the output size limits from the environment variables
+// MAX_WIDTH, MAX_HEIGHT, MAX_MEGAPIXELS and MAX_SIZE_MODE (reject or clamp)
+func initLimits() error {
+	var err error
+	if maxWidth, err = envUint("MAX_WIDTH", maxWidth); err != nil {
+		return err
+	}
+	if maxHeight, err = envUint("MAX_HEIGHT", maxHeight); err != nil {
+		return err
+	}
+	if v := os.Getenv("MAX_MEGAPIXELS"); v != "" {
+		maxMegapixels, err = strconv.ParseFloat(v, 64)
+		if err != nil || maxMegapixels <= 0 {
+			return fmt.Errorf("Invalid environment variable MAX_MEGAPIXELS %s, must be a positive number", v)
+		}
+	}
+	switch v := os.Getenv("MAX_SIZE_MODE"); v {
+	case "", "reject":
+		clampOversize = false
+	case "clamp":
+		clampOversize = true
+	default:
+		return fmt.Errorf("Invalid environment variable MAX_SIZE_MODE %s, must be reject or clamp", v)
+	}
+	return nil
+}
+
+func envUint(name string, d uint) (uint, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return d, nil
+	}
+	i, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || i == 0 {
+		return d, fmt.Errorf("Invalid environment variable %s %s, must be a positive number", name, v)
+	}
+	return uint(i), nil
+}
+
+// checkLimits makes sure the requested output size including the dpr is inside the server limits.
+// Oversize requests are rejected with a bad params error or scaled down when clamping.
+func checkLimits(pd *parametersData) error {
+	d := math.Max(pd.DPR, 1)
+	ew := float64(pd.RW) * d
+	eh := float64(pd.RH) * d
+	if pd.RW == 0 && pd.RH == 0 {
+		//without a resize the crop is the output
+		ew = float64(pd.CW)
+		eh = float64(pd.CH)
+	}
+
+	f := 1.0
+	if ew > float64(maxWidth) {
+		f = math.Min(f, float64(maxWidth)/ew)
+	}
+	if eh > float64(maxHeight) {
+		f = math.Min(f, float64(maxHeight)/eh)
+	}
+	if mp := ew * eh / 1000000; mp > maxMegapixels {
+		f = math.Min(f, math.Sqrt(maxMegapixels/mp))
+	}
+	if f == 1 {
+		return nil
+	}
+
+	if !clampOversize {
+		msg := "Requested size " + strconv.Itoa(int(ew)) + "x" + strconv.Itoa(int(eh)) + " is over the limit of " +
+			uintToString(maxWidth) + "x" + uintToString(maxHeight) + " and " + strconv.FormatFloat(maxMegapixels, 'f', -1, 64) + " megapixels"
+		pd.log(msg)
+		return newImageError(errKindBadParams, msg, nil)
+	}
+
+	if pd.RW == 0 && pd.RH == 0 {
+		pd.CW = scaleDim(pd.CW, f)
+		pd.CH = scaleDim(pd.CH, f)
+	} else {
+		if pd.RW > 0 {
+			pd.RW = scaleDim(pd.RW, f)
+		}
+		if pd.RH > 0 {
+			pd.RH = scaleDim(pd.RH, f)
+		}
+	}
+	pd.log("Clamped oversize request to rw=" + uintToString(pd.RW) + ", rh=" + uintToString(pd.RH) + ", cw=" + uintToString(pd.CW) + ", ch=" + uintToString(pd.CH))
+	return nil
+}
+
+// limitSize scales x by y down to the server limits keeping the aspect ratio,
+// for sizes worked out from the source like the height for a width only resize
+func limitSize(x uint, y uint) (uint, uint) {
+	f := 1.0
+	if x > maxWidth {
+		f = math.Min(f, float64(maxWidth)/float64(x))
+	}
+	if y > maxHeight {
+		f = math.Min(f, float64(maxHeight)/float64(y))
+	}
+	if mp := float64(x) * float64(y) / 1000000; mp > maxMegapixels {
+		f = math.Min(f, math.Sqrt(maxMegapixels/mp))
+	}
+	if f == 1 {
+		return x, y
+	}
+	return scaleDim(x, f), scaleDim(y, f)
+}
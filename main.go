@@ -10,12 +10,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -23,21 +29,22 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jsaterfiel/go-imagick/signature"
+	"github.com/jsaterfiel/go-imagick/transform"
 	"gopkg.in/gographics/imagick.v3/imagick"
 	redis "gopkg.in/redis.v4"
 )
 
 var imgBaseDir string
 
-var remoteImgURL string
-
 const redisKeyLockPrefix = "imageServer_lock_"
 const redisKeyCachePrefix = "imageServer_cache_"
 const redisKeyCacheFormatPrefix = "imageServer_cache_format_"
 const redisKeyCacheObjectPrefix = "imageServer_cache_object_"
+const redisKeyCacheModifiedPrefix = "imageServer_cache_modified_"
 
-//5 second timeout
-const imageFetchTimeout = time.Duration(5) * time.Second
+//how long a fetch lock is held, set from the http client settings to cover a fetch with every retry
+var imageFetchTimeout = time.Duration(5) * time.Second
 
 //5 minute timeout
 const imageCacheTimeout = time.Duration(5) * time.Minute
@@ -45,6 +52,15 @@ const imageCacheTimeout = time.Duration(5) * time.Minute
 //1 hour timeout
 const objectCacheTimeout = time.Duration(1) * time.Hour
 
+//max-age sent in the Cache-Control header of images, set with CACHE_MAX_AGE
+var cacheMaxAge = time.Duration(1) * time.Hour
+
+//number of frames kept for animation preview mode
+const animationPreviewFrames = 5
+
+//1.5 second delay between frames for animation preview mode, in ticks of 1/100th of a second
+const animationPreviewDelay = 150
+
 var imageNotFoundPath string
 
 var imageIDQuery string
@@ -53,9 +69,15 @@ var redisADDR string
 
 var redisClient *redis.Client
 
+//secret used to verify signed urls, signing is disabled when empty
+var signingSecret []byte
+
+//parameter and query string parameter that clear the cache of the request
+const refreshParam = "cacheRefresh"
+
 //var s3Client *s3.S3
 
-const imageIDQueryString = "jp/[NAMESPACE]?&q={%22select%22:{%22virtualImageParams%22:{%22*%22:1},%22imageAssetRefs%22:{%22height%22:1,%22width%22:1,%22URI%22:1},%22ImagesWithCaptions%22:{%22Image%22:{%22virtualImageParams%22:{%22*%22:1},%22imageAssetRefs%22:{%22height%22:1,%22width%22:1,%22URI%22:1}}},%22virtualImageParams%22:{%22*%22:1},%22Images%22:{%22virtualImageParams%22:{%22*%22:1},%22imageAssetRefs%22:{%22height%22:1,%22width%22:1,%22URI%22:1}}},%22vars%22:{},%22where%22:{%22byId%22:[%22[KEYID]%22]},%22start%22:0,%22rows%22:1,%22omitNumFound%22:true,%22debug%22:{}}&stage=authoring&filterSchedules=true&dateFormat=UTC"
+const imageIDQueryString = "jp/[NAMESPACE]?&q={%22select%22:{%22focalPoint%22:{%22*%22:1},%22virtualImageParams%22:{%22*%22:1},%22imageAssetRefs%22:{%22height%22:1,%22width%22:1,%22URI%22:1},%22ImagesWithCaptions%22:{%22Image%22:{%22focalPoint%22:{%22*%22:1},%22virtualImageParams%22:{%22*%22:1},%22imageAssetRefs%22:{%22height%22:1,%22width%22:1,%22URI%22:1}}},%22virtualImageParams%22:{%22*%22:1},%22Images%22:{%22focalPoint%22:{%22*%22:1},%22virtualImageParams%22:{%22*%22:1},%22imageAssetRefs%22:{%22height%22:1,%22width%22:1,%22URI%22:1}}},%22vars%22:{},%22where%22:{%22byId%22:[%22[KEYID]%22]},%22start%22:0,%22rows%22:1,%22omitNumFound%22:true,%22debug%22:{}}&stage=authoring&filterSchedules=true&dateFormat=UTC"
 
 // uri/mgid:file:gsp:entertainment-assets:/mtv/arc/images/news/DailyNewsHits/photos/160512_YACHT_SOCIAL_thumbnail.png
 const helpMsg = `<pre style="font-family:monospace">
@@ -63,12 +85,21 @@ const helpMsg = `<pre style="font-family:monospace">
 | Help
 ========================================================================================================================
 
+Parameters are key=value pairs separated by colons.  Values are url encoded so they can hold : and = (%3A and %3D)
+Unknown parameters and invalid values get a 400, add ?debug to the url to see which parameters were wrong
+
 How to make an url with uri:
 ------------------------------------------------------------------------------------------------------------------------
 /uri/{your parameters separated by colons}/{image mgid string}
 Example:
 /uri/rw=480:rh=320:ch=600:cw=800:cx=200:cy=200:q=50/mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/videos/season_21/21095/ds_21_095_act2.jpg
 
+How to make an url with a relative image path: (the parameters segment is optional)
+------------------------------------------------------------------------------------------------------------------------
+/img/{your parameters separated by colons}/{relative image path}
+Example:
+/img/rw=480:rh=320:q=50/shows/tds/season_21/ds_21_095_act2.jpg
+
 How to make an url with image id:
 ------------------------------------------------------------------------------------------------------------------------
 /oid/{your parameters separated by colons}/{image mgid string}
@@ -81,10 +112,55 @@ Example:
 /oid/rw=1920:rh=1080:q=90/mgid:arc:video:comedycentral.com:7c2d44b4-c8b1-43a9-9bfc-32af988eab20
 691 461
 
-Resize Parameters: (only need one of the parameters)
+How to get the urls of an image for srcset and picture markup:
+------------------------------------------------------------------------------------------------------------------------
+/manifest/{your parameters separated by colons}/{image mgid string}
+Returns json listing the url, width and height of the image at each of the server's widths and formats without making them
+rw sets the width of each url and rh keeps the shape of the rw by rh box.  Arc mgids get /oid/ urls
+Example:
+/manifest/rw=480:rh=320:fit=cover/mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/videos/season_21/21095/ds_21_095_act2.jpg
+
+
+How to get information about an image:
+------------------------------------------------------------------------------------------------------------------------
+/info/{image mgid string}
+Returns json with the size, format, frame count, alpha channel, colorspace, file size and exif of the original image
+Arc mgids also get the crop sets /oid/ picks from and the focal point
+Example:
+/info/mgid:arc:video:comedycentral.com:2b469942-7bba-4d3a-9393-e9355f710d2c
+
+
+Preset Parameters:
+------------------------------------------------------------------------------------------------------------------------
+p - Name of a preset from the server's presets file.  Other parameters in the url override the preset's values
+    Parameters that override each other replace the preset's as a group, so any of cg, cc, cx, cy, fx or fy in the url
+    drops all of the preset's crop placement and either of fit or pad drops the preset's fit and pad
+Example:
+/uri/p=card-small:q=80/mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/videos/season_21/21095/ds_21_095_act2.jpg
+
+
+Resize Parameters: (only need one of the parameters.  Sizes over the server limits get a 400 or are scaled down to fit, depending on the server)
 ------------------------------------------------------------------------------------------------------------------------
 rw - Resize width in pixels
 rh - Resize height in pixels
+up - Allow upscaling past the size of the image.  true(1) false(0)  Default is false
+dpr - Device pixel ratio, multiplies rw and rh (or cw and ch when not resizing) for retina screens.  Up to 4
+      Lowered when the source isn't big enough so the image is never upscaled.  The DPR and Sec-CH-DPR client hint headers are used when not given
+fit - How to resize when both rw and rh are given.  Default is fill
+      cover - scale to cover both dimensions then crop the overflow from the center
+      contain - scale to fit inside both dimensions then letterbox to the full size
+      fill - stretch to both dimensions ignoring the aspect ratio
+      inside - scale to fit inside both dimensions, the image may be smaller than requested
+      outside - scale to cover both dimensions, the image may be larger than requested
+pad - Center the resized image on a canvas of the requested size.  true(1) false(0)  Default is false
+bg - Background color for contain and pad as hex without the # (ff0000, f00, ff000080) or a name (red, transparent)
+     Default is transparent for images with an alpha channel otherwise white.  Transparent needs a png, gif, webp, avif or jxl output
+
+
+Orientation Parameters: (images are always turned upright from their exif orientation first.  Crop and resize happen after)
+------------------------------------------------------------------------------------------------------------------------
+rot - Rotate clockwise in degrees, 90, 180, 270 or any other angle which fills the corners with the bg color
+flip - Mirror the image, h for horizontal, v for vertical or hv for both
 
 
 Crop Parameters: (both crop width and crop height are required)
@@ -94,45 +170,98 @@ ch - Crop height in pixels
 cx - Crop x offset in pixels from top left as 0,0. Default is 0.
 cy - Crop y offset in pixels from top left as 0,0. Default is 0.
 cc - Crop to the center of the image.  Overrides cx and cy when used. true(1) false(0)  Default is false;
+cg - Crop gravity, where to take the crop from.  Overrides cc, cx and cy when used.  Also used by fit=cover
+     n, s, e, w, ne, nw, se, sw, center - keep that side or corner of the image
+     entropy - keep the busiest region of the image
+     attention - keep the region with the most detail (strongest edges)
+fx - Focal point x as a fraction of the width from the left 0 to 1.  The crop is centered on the focal point as near as the image allows
+fy - Focal point y as a fraction of the height from the top 0 to 1.  Overrides cg, cc, cx and cy.  Also used by fit=cover
+     /oid/ images use the arc focal point when neither the focal point nor cg are given
 
 
 Quality Parameters: (if not passed no quality processing occurs.  Does nothing for gifs.)
 ------------------------------------------------------------------------------------------------------------------------
-q - Quality, can be 0.5 or 50 but 1 is just 1 out of 100.
-f - Format, can be either jpg, png or webp(lossy).  Does nothing for animated gifs
+q - Quality, a percentage 1 to 100 or with a decimal point a fraction of 1.  So 50 and 0.5 are the same, 1 is 1 out of 100 and 1.0 is 100
+f - Format, can be either jpg, png, gif, webp(lossy), avif or jxl.  Does nothing for animated gifs
+    Without f the format is picked from the Accept header in the order avif, webp then the source format (jpg, png or gif)
 n - Normalize, enhances the contrast of a color image by adjusting the pixels color to span the entire range of colors available on all channels.  Not available on gifs.  true(1) false(0)  Default is false;
 
 
+Effect Parameters: (applied after resizing in this order whatever order they are given in, to every frame of animated gifs)
+------------------------------------------------------------------------------------------------------------------------
+bri - Brightness -100 to 100
+con - Contrast -100 to 100
+sat - Saturation -100 to 100
+hue - Hue rotation in degrees -180 to 180
+gray - Grayscale.  true(1) false(0)  Default is false
+sepia - Sepia tone threshold 0 to 100, 80 is a good start
+blur - Gaussian blur sigma 0 to 20
+sharp - Sharpen sigma 0 to 20
+
+
+Text Parameters: (drawn after resizing and effects, to every frame of animated gifs)
+------------------------------------------------------------------------------------------------------------------------
+txt - Text to draw, url encoded including any : or = (%3A and %3D).  New lines (%0A) start a new line.  Up to 256 characters
+txf - Font name from the server's font directory.  Default is the server's default font
+txs - Font size in pixels 1 to 400.  Default is 24
+txc - Text color as hex without the # or a name, same as bg.  Default is white
+txsc - Outline color, same as bg.  Default is black
+txsw - Outline width in pixels 0 to 20.  Default is 0 (no outline)
+txg - Where to place the text, n, s, e, w, ne, nw, se, sw or center.  Default is s
+txw - Wrap lines wider than this many pixels.  Default is the image width less a margin of half the font size
+Example:
+/uri/rw=480:txt=Breaking%3A%20News:txs=32:txsw=2/mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/videos/season_21/21095/ds_21_095_act2.jpg
+
+
+Watermark Parameters: (the overlay is added after resizing and effects, to every frame of animated gifs)
+------------------------------------------------------------------------------------------------------------------------
+wm - Name of the overlay image, a png kept with the original images under the watermark prefix.  Unknown names get a 400
+wmg - Where to place the overlay, n, s, e, w, ne, nw, se, sw or center.  Default is se
+wmm - Margin between the overlay and the image edges in pixels.  Default is 0
+wmo - Opacity of the overlay in percent 1 to 100.  Default is 100
+wms - Overlay width as a fraction of the image width 0 to 1.  Default is the overlay's own size
+      The overlay is always shrunk to fit inside the margins
+
+
 Animation Mode Parameters: (params used for handling animated gifs)
 ------------------------------------------------------------------------------------------------------------------------
 am=s - Get still image (ie first frame of animated gif)
 am=p - Get animated gif in preview mode which reduces the frames to 5 and sets the delay per frame to 1.5 seconds
 
 
+Signed URLs: (only when the server is started with URL_SIGNING_SECRET, needed by /uri/, /oid/, /img/, /manifest/ and /info/)
+------------------------------------------------------------------------------------------------------------------------
+sig - HMAC signature of the other parameters and the image mgid string.  Create signed urls with cmd/signurl
+cacheRefresh - Same as the cacheRefresh query string parameter but covered by the signature.  cacheRefresh=1
+               The query string parameter is ignored on signed urls so only urls signed with it can refresh the cache
+Example:
+/uri/rw=480:rh=320:q=50:sig={signature}/mgid:file:gsp:entertainment-assets:/cc/images/shows/tds/videos/season_21/21095/ds_21_095_act2.jpg
+
+
 Query String Parameters:
 ------------------------------------------------------------------------------------------------------------------------
 help - Returns this page
 debug - Returns information about how the requested url was processed. No image is returned
-cacheRefresh - clears the cache for this image request and fetches the image from the remote url
+cacheRefresh - clears the cache for this image request and fetches the image from the remote url.  Ignored when urls are signed
 </pre>`
 
 type parametersData struct {
-	rw           uint
-	rh           uint
-	cw           uint
-	ch           uint
-	cx           int
-	cy           int
-	cc           bool
-	q            uint
-	f            string
-	n            bool
-	am           string
+	transform.Transform
+	ctx          context.Context
+	dprParam     bool
 	cacheRefresh bool
 	debug        bool
 	msgs         []string
 }
 
+// context returns the request context so remote fetches stop when the client goes away
+func (pd *parametersData) context() context.Context {
+	if pd.ctx == nil {
+		return context.Background()
+	}
+	return pd.ctx
+}
+
 func (pd *parametersData) log(msg string) {
 	fmt.Println(msg)
 	if pd.debug {
@@ -140,101 +269,64 @@ func (pd *parametersData) log(msg string) {
 	}
 }
 
-type responseWrapper struct {
-	response struct {
-		docs []json.RawMessage
-	}
-}
-
-type imageFormat struct {
-	typeName string
-}
-
-type imageAssetRefs struct {
-	format imageFormat
-	height uint
-	width  uint
-	uri    string
-}
-
-type virtualImageParams struct {
-	topLeftX       int
-	topLeftY       int
-	cropSizeWeight uint
-	cropSizeHeight uint
-}
-
-type image struct {
-	imageAssetRefs     []imageAssetRefs
-	virtualImageParams []virtualImageParams
-}
-
-type item struct {
-	images             []image
-	imagesWithCaptions []struct {
-		image image
-	}
-	image
-}
-
 func handlerHelp(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	fmt.Fprint(w, helpMsg)
 }
 
-func parseUint(s string) uint {
-	i, err := strconv.ParseFloat(s, 10)
-	if err == nil {
-		if i < 1 {
-			i = i * 100
+// findParams parses the parameter segment s of the image m into pd.
+// A preset is applied first so the other parameters override it wherever they are in the segment.
+// The signature is left out as it has already been checked by the handler.
+func findParams(s string, m string, pd *parametersData) error {
+	p, _ := signature.Split(s)
+	p, n := splitPreset(p)
+	p, cr := splitRefresh(p)
+	if cr {
+		pd.cacheRefresh = true
+	}
+	var errs transform.Errors
+	if n != "" {
+		if ps, ok := presets.get(n); ok {
+			ps = overridePreset(ps, p)
+			pd.log("Using preset " + n + ": " + ps)
+			//presets are validated when they are loaded
+			pd.Parse(ps)
+		} else {
+			errs = append(errs, &transform.FieldError{Key: presetParam, Value: n, Msg: "unknown preset"})
+		}
+	}
+	if err := pd.Parse(p); err != nil {
+		errs = append(errs, err.(transform.Errors)...)
+	}
+	if pd.Txf != "" {
+		if _, ok := fontPath(pd.Txf); !ok {
+			errs = append(errs, &transform.FieldError{Key: "txf", Value: pd.Txf, Msg: "unknown font"})
 		}
-		return uint(i)
 	}
-	fmt.Println("Failed to convert number: ", s)
-	return uint(0)
+	if len(errs) > 0 {
+		for _, fe := range errs {
+			fmt.Println("Invalid Parameter ", fe, ", for mgid=", m)
+			pd.log("Invalid parameter " + fe.Error())
+		}
+		return newImageError(errKindBadParams, "Invalid parameters", errs)
+	}
+	pd.log("found params: " + pd.String())
+	return nil
 }
 
-func findParams(s string, m string, pd *parametersData) {
-	for _, v := range strings.Split(s, ":") {
-		nv := strings.Split(v, "=")
-		if len(nv) != 2 {
+// splitRefresh takes the cache refresh parameter out of the parameter segment p returning the rest and whether it was set.
+// Unlike the query string it is covered by the signature so it is how signed urls refresh the cache.
+func splitRefresh(p string) (string, bool) {
+	var cr bool
+	var ps []string
+	for _, v := range strings.Split(p, ":") {
+		if strings.HasPrefix(v, refreshParam+"=") {
+			cr, _ = strconv.ParseBool(v[len(refreshParam)+1:])
 			continue
 		}
-		switch nv[0] {
-		case "rw":
-			pd.rw = parseUint(nv[1])
-		case "rh":
-			pd.rh = parseUint(nv[1])
-		case "cw":
-			pd.cw = parseUint(nv[1])
-		case "ch":
-			pd.ch = parseUint(nv[1])
-		case "cx":
-			i, err := strconv.Atoi(nv[1])
-			if err == nil {
-				pd.cx = i
-			}
-		case "cy":
-			i, err := strconv.Atoi(nv[1])
-			if err == nil {
-				pd.cy = i
-			}
-		case "cc":
-			pd.cc = nv[1] == "1"
-		case "q":
-			pd.q = parseUint(nv[1])
-		case "f":
-			pd.f = nv[1]
-		case "n":
-			pd.n = nv[1] == "1"
-		case "am":
-			pd.am = nv[1]
-		default:
-			fmt.Println("Unknown Parameter=", nv[0], ", for mgid=", m)
-			pd.log("Unknown Parameter: " + nv[0])
-		}
-		pd.log("found param: " + nv[0] + "=" + nv[1])
+		ps = append(ps, v)
 	}
+	return strings.Join(ps, ":"), cr
 }
 
 func uintToString(v uint) string {
@@ -246,36 +338,70 @@ func intToString(v int) string {
 }
 
 func floatToString(v float64) string {
-	return strconv.FormatFloat(float64(v), 'E', 3, 10)
+	return strconv.FormatFloat(v, 'E', 3, 64)
 }
 
 // p is the path to the image
-func setImageFetchLock(p string, pd *parametersData) bool {
+// returns the token the lock was set with which is needed to release it and whether the lock was taken
+func setImageFetchLock(p string, pd *parametersData) (string, bool) {
 	k := redisKeyLockPrefix + p
-	v := redisClient.SetNX(k, "true", imageFetchTimeout)
+	t := make([]byte, 16)
+	if _, err := rand.Read(t); err != nil {
+		fmt.Println("Unable to make a lock token: ", err)
+		pd.log("Unable to make a lock token: " + err.Error())
+		return "", false
+	}
+	tok := hex.EncodeToString(t)
+	v := redisClient.SetNX(k, tok, imageFetchTimeout)
 	if v.Err() != nil {
 		fmt.Println("Unable to set the key: ", k, v.Err())
 		pd.log("Unable to set the key: " + k + "; ERROR: " + v.Err().Error())
 	}
-	return v.Val()
+	return tok, v.Val()
+}
+
+// route is the route prefix without slashes, such as uri or manifest, which is part of the signed string
+// po is the request path without the route prefix
+// returns true when signing is disabled or the path carries a valid signature
+func verifySignature(route string, po string, pd *parametersData) bool {
+	if len(signingSecret) == 0 {
+		return true
+	}
+	mi := strings.Index(po, "/")
+	if mi == -1 {
+		pd.log("Missing signature for path: " + po)
+		return false
+	}
+	p, sig := signature.Split(po[:mi])
+	if sig == "" || !signature.Verify(signingSecret, route, p, po[mi+1:], sig) {
+		fmt.Println("Invalid signature for path: ", po)
+		pd.log("Invalid signature for path: " + po)
+		return false
+	}
+	return true
 }
 
 // i is image path
 // f is the requested format (if any)
 // ha is header accept string
 // ac is has alpha channel
-func getImageFormat(i string, f string, ha string, ac bool, pd *parametersData) string {
-	if f != "" {
-		return strings.ToLower(f)
+// an is the image has more than one frame
+func getImageFormat(i string, f string, ha string, ac bool, an bool, pd *parametersData) string {
+	if of := negotiateFormat(f, ha); of != "" {
+		if f == "" {
+			if an && !animatedFormats[of] {
+				//keep the animation rather than sending only the first frame
+				of = animatedFallback(ha)
+			}
+			pd.log("browser accepts " + of + " changing image format to " + of)
+		}
+		return of
 	}
 
 	of := strings.ToLower(i[strings.LastIndex(i, ".")+1:])
 
 	//Handle image format change
-	if strings.Contains(ha, "image/webp") {
-		of = "webp"
-		pd.log("browser accepts webp changing image format to webp")
-	} else if of != "gif" && !ac || of == "jpeg" {
+	if of != "gif" && !ac || of == "jpeg" {
 		pd.log("changing image format to jpeg")
 		of = "jpg"
 	}
@@ -283,87 +409,151 @@ func getImageFormat(i string, f string, ha string, ac bool, pd *parametersData)
 	return of
 }
 
-func loadMissingImage(mw *imagick.MagickWand, pd *parametersData) {
+// loadMissingImage returns the default image served in place of images that can't be found
+func loadMissingImage(pd *parametersData) ([]byte, error) {
 	fp := imgBaseDir + imageNotFoundPath
 	//check if the file exists
 	i, err := ioutil.ReadFile(fp)
 	if err != nil || i == nil {
 		//file not found locally fetch remote
 		//see if any other process is fetching the image.  if so then return 404 for now.
-		err = nil
-		if setImageFetchLock(fp, pd) {
-			fetchRemoteImageURL(imageNotFoundPath, imageNotFoundPath, pd, mw)
-		} else {
+		tok, ok := setImageFetchLock(fp, pd)
+		if !ok {
 			fmt.Println("Cannot load default image", fp)
-			panic("Cannot load default image")
+			return nil, newImageError(errKindProcessing, "Cannot load default image", err)
 		}
-	} else {
-		pd.log("Found image locally: " + fp)
-		err := mw.ReadImageBlob(i)
+		i, err = fetchRemoteImageURL(imageNotFoundPath, imageNotFoundPath, pd)
+		releaseImageFetchLock(fp, tok, pd)
 		if err != nil {
-			fmt.Println("Error while reading image blob", err)
-			pd.log("Error while reading image blob: " + err.Error())
+			fmt.Println("Cannot load default image", fp, err)
+			return nil, newImageError(errKindProcessing, "Cannot load default image", err)
 		}
+		return i, nil
 	}
+	pd.log("Found image locally: " + fp)
+	return i, nil
 }
 
-func fetchRemoteImageURL(m string, p string, pd *parametersData, mw *imagick.MagickWand) {
-	url := remoteImgURL + m + "?q=.9"
-	pd.log("Remote fetch Image: " + url)
+// fetchRemoteImageURL fetches the image m from the origin and saves it locally as p for future requests
+func fetchRemoteImageURL(m string, p string, pd *parametersData) ([]byte, error) {
+	pd.log("Remote fetch Image: " + m)
 	//try to remotely fetch the image
-	resp, err := http.Get(url)
-
-	if err != nil {
-		fmt.Println("Error remote url fetch, path: ", url)
-		pd.log("Error remote url fetch, path: " + url)
-		loadMissingImage(mw, pd)
-		return
-	}
-
-	defer resp.Body.Close()
-
-	i, err := ioutil.ReadAll(resp.Body)
+	i, ct, _, err := imageOrigin.Fetch(pd.context(), m)
 	if err != nil || i == nil {
-		fmt.Println("Failed to fetch remote image: ", url, err)
-		pd.log("Failed to fetch remote image: " + err.Error())
-		loadMissingImage(mw, pd)
-		return
+		fmt.Println("Failed to fetch remote image: ", m, err)
+		pd.log("Failed to fetch remote image: " + m)
+		if err == nil {
+			return nil, newImageError(errKindOrigin, "Failed to fetch image", nil)
+		}
+		return nil, toImageError(err)
+	}
+	if !isImageContent(ct, i) {
+		//never write error pages or other non image responses to disk
+		fmt.Println("Remote fetch is not an image: ", m, ct)
+		pd.log("Remote fetch is not an image: " + m + ", Content-Type: " + ct)
+		return nil, newImageError(errKindOrigin, "Origin response is not an image", nil)
 	}
 
-	pd.log("Fetched Remote Image: " + url)
+	pd.log("Fetched Remote Image: " + m + ", Content-Type: " + ct)
 
 	//get image folder path
-	ifi := strings.LastIndex(p, "/")
-	ifp := imgBaseDir + p[:ifi]
+	//relative image paths may sit directly in the image folder
+	ifp := path.Dir(imgBaseDir + p)
 
 	pd.log("Creating Directories: " + ifp)
 
 	//write out the image to file for future usage
+	//failing to save locally only costs another remote fetch next time so the image is still served
 	err = os.MkdirAll(ifp, 0777)
 	if err != nil {
 		fmt.Println("Failed to create new directories for path: ", ifp, err)
-		panic(err)
+		pd.log("Failed to create new directories for path: " + ifp + ", Error: " + err.Error())
+		return i, nil
 	}
 
 	ip := imgBaseDir + p
-	f, err := os.Create(ip)
+	err = writeFileAtomic(ip, i)
+	if err != nil {
+		fmt.Println("Failed to write to file: ", ip, err)
+		pd.log("Failed to write to file: " + err.Error())
+		return i, nil
+	}
+	pd.log("Bytes written to file: " + fmt.Sprint(len(i)))
+	return i, nil
+}
 
+// writeFileAtomic writes b to a temp file next to the file at p then renames it into place,
+// so requests and other instances reading p never see a partly written image
+func writeFileAtomic(p string, b []byte) error {
+	tf, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p)+".tmp")
 	if err != nil {
-		fmt.Println("Failed to create file: ", ip, err)
-		panic(err)
-	} else {
-		defer f.Close()
+		return err
+	}
+	_, err = tf.Write(b)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		//temp files are created 0600 so let other users read the image like before
+		err = os.Chmod(tf.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tf.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+	}
+	return err
+}
+
+// getAnimationFrames returns a new wand containing the frames selected by the animation mode.
+// mw must already be coalesced so every frame is a complete image.
+func getAnimationFrames(mw *imagick.MagickWand, pd *parametersData) *imagick.MagickWand {
+	var idx []int
+	n := int(mw.GetNumberImages())
+
+	switch pd.AM {
+	case "s":
+		//still image is just the first frame
+		idx = append(idx, 0)
+	case "p":
+		if n <= animationPreviewFrames {
+			for i := 0; i < n; i++ {
+				idx = append(idx, i)
+			}
+		} else {
+			//evenly space the frames across the animation always including the first and last frame
+			for i := 0; i < animationPreviewFrames; i++ {
+				idx = append(idx, i*(n-1)/(animationPreviewFrames-1))
+			}
+		}
 	}
 
-	ib, err := f.Write(i)
-	pd.log("Bytes written to file: " + fmt.Sprint(ib))
-	if ib < 1 && err != nil {
-		fmt.Println("Failed to write to file: ", ip)
-		pd.log("Failed to write to file: " + err.Error())
-		panic(err)
+	aw := imagick.NewMagickWand()
+	for _, v := range idx {
+		mw.SetIteratorIndex(v)
+		fw := mw.GetImage()
+		aw.AddImage(fw)
+		fw.Destroy()
+	}
+
+	if pd.AM == "p" {
+		for i := 0; i < int(aw.GetNumberImages()); i++ {
+			aw.SetIteratorIndex(i)
+			aw.SetImageDelay(animationPreviewDelay)
+		}
+	}
+	pd.log("Animation mode " + pd.AM + " kept " + intToString(len(idx)) + " of " + intToString(n) + " frames")
+	return aw
+}
+
+// isImageContent reports whether the fetched bytes are an image.
+// Origins like s3 often report application/octet-stream so anything not declared as an image is sniffed.
+func isImageContent(ct string, b []byte) bool {
+	if strings.HasPrefix(ct, "image/") {
+		return true
 	}
-	mw.ReadImageBlob(i)
-	//mw.ReadImageFile(f)
+	return strings.HasPrefix(http.DetectContentType(b), "image/")
 }
 
 func saveImageInS3(path string, data []byte, pd *parametersData) {
@@ -385,295 +575,86 @@ func saveImageInS3(path string, data []byte, pd *parametersData) {
 	}
 }
 
-func getObjectHelper(id string, namespace string, pd *parametersData) json.RawMessage {
-	var o []byte
-	var rerr error
-	u := strings.Replace(imageIDQuery, "[NAMESPACE]", namespace, 1)
-	u = strings.Replace(u, "[KEYID]", id, 1)
-	pd.log("Fetching arc call: " + u)
-	//check cache to see if we've already made this call
-	if pd.cacheRefresh == false {
-		cc := redisClient.Get(redisKeyCacheObjectPrefix + u)
-		o, _ = cc.Bytes()
+// splitPathParams splits a generic image path into its parameter segment and relative image path.
+// The first segment is only treated as parameters when it contains an equals sign.
+func splitPathParams(po string) (string, string) {
+	mi := strings.Index(po, "/")
+	if mi == -1 || !strings.Contains(po[:mi], "=") {
+		return "", po
 	}
-	if o == nil {
-		//go get the data from arc
-		pd.log("fetching data from arc not found in cache")
-		resp, err := http.Get(u)
+	return po[:mi], po[mi+1:]
+}
 
+// parseImagePath parses the parameters of the request path po, without the route prefix, into pd.
+// It returns the image mgid or, for routePath, the cleaned relative image path.
+func parseImagePath(po string, rt routeType, pd *parametersData) (string, error) {
+	if rt == routePath {
+		//images by relative path don't use mgids so the path is the origin key and local cache path
+		nv, rp := splitPathParams(po)
+		rp, err := url.PathUnescape(rp)
 		if err != nil {
-			fmt.Println("Error remote url fetch for object by url: ", u, err)
-			pd.log("Error remote url fetch for object by url: " + err.Error())
-			return nil
+			pd.log("404: Invalid image path encoding")
+			return "", newImageError(errKindNotFound, "Invalid image request", nil)
 		}
-		defer resp.Body.Close()
-
-		o, rerr = ioutil.ReadAll(resp.Body)
-		if rerr != nil {
-			fmt.Println("Error while fetching query", u, rerr)
-			pd.log("Error while fetching query: " + rerr.Error())
-			return nil
+		id := path.Clean("/" + rp)[1:]
+		if id == "" {
+			pd.log("404: Invalid image request")
+			return "", newImageError(errKindNotFound, "Invalid image request", nil)
 		}
-
-		//save in cache
-		redisClient.Set(redisKeyCacheObjectPrefix+u, o, objectCacheTimeout)
-	}
-
-	var data responseWrapper
-
-	if err := json.Unmarshal(o, &data); err != nil {
-		panic(err)
-	}
-
-	if len(data.response.docs) != 1 {
-		fmt.Println("Failed to fetch object by id:", id, " url: ", u)
-		return nil
-	}
-	return data.response.docs[0]
-}
-
-//getBestImageByMgidID
-//returns id, crop width, crop height, offset x, offset y
-func getBestImageByMgidID(id string, pd *parametersData) (string, uint, uint, int, int) {
-	var item item
-	var imgs []image
-	var bestImg image
-	var bestCropSet virtualImageParams
-	var bestCropSetWidth float64
-	var bestCropSetHeight float64
-	var bestImgInitted = false
-	var bestImgRatio float64
-	var ratio float64
-
-	mgidPieces := strings.Split(id, ":")
-
-	//example mgid
-	//mgid:arc:video:<namespace>:<uuid>
-	//TODO: allow for other handlers besides arc
-	if len(mgidPieces) < 5 {
-		//invalid mgid, mgids must be 5 pieces
-	}
-
-	if mgidPieces[1] != "arc" {
-		fmt.Println("invalid provider we only support arc currently")
-		pd.log("invalid provider we only support arc currently")
-		return "", 0, 0, 0, 0
-	}
-	raw := getObjectHelper(mgidPieces[4], mgidPieces[3], pd)
-
-	json.Unmarshal(raw, &item)
-
-	if len(item.imageAssetRefs) > 0 {
-		//image object
-		json.Unmarshal(raw, &bestImg)
-		imgs = append(imgs, bestImg)
-	} else {
-		//item object
-		//check imagewithcaptions first then images
-		for i := 0; i < len(item.imagesWithCaptions); i++ {
-			imgs = append(imgs, item.imagesWithCaptions[i].image)
-		}
-		for i := 0; i < len(item.images); i++ {
-			imgs = append(imgs, item.images[i])
-		}
-	}
-
-	if len(imgs) == 0 {
-		return "", 0, 0, 0, 0
-	}
-
-	if pd.cw == 0 || pd.ch == 0 {
-		//if neither width or height are provided then grab first image and live with it
-		return imgs[0].imageAssetRefs[0].uri, 0, 0, 0, 0
-	}
-
-	ratio = math.Floor((float64(pd.cw) / float64(pd.ch)) * 10)
-
-	//now run back through them all and find the image that best fits the requested width and height
-	//if only width or height are specified grab first image that is greater than the provided values
-	pd.log("finding best image...")
-	for i := 0; i < len(imgs); i++ {
-		pd.log("img index: " + intToString(i))
-		if bestImgInitted == false {
-			pd.log("always pick the first image by default")
-			bestImg = imgs[i]
-			bestImgRatio = math.Floor((float64(bestImg.imageAssetRefs[0].width) / float64(bestImg.imageAssetRefs[0].height)) * 10)
-			bestImgInitted = true
-
-			if len(imgs[i].virtualImageParams) > 0 {
-				bestCropSet = imgs[i].virtualImageParams[0]
-				pd.log("best crop called-init: ch=" + uintToString(bestCropSet.cropSizeHeight) + ", cw=" + uintToString(bestCropSet.cropSizeWeight) + ", x=" + intToString(bestCropSet.topLeftX) + ", y=" + intToString(bestCropSet.topLeftY))
-				bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-				bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-				bestImgRatio = math.Floor((float64(bestImg.imageAssetRefs[0].width) / float64(bestImg.imageAssetRefs[0].height)) * 10)
-
-				for j := 0; j < len(bestImg.virtualImageParams); j++ {
-					newRatio := math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					diffwidth := math.Abs(float64(pd.cw - imgs[i].virtualImageParams[j].cropSizeWeight))
-					diffHeight := math.Abs(float64(pd.ch - imgs[i].virtualImageParams[j].cropSizeHeight))
-					pd.log("original ratio: " + floatToString(ratio) + ", new ratio: " + floatToString(newRatio))
-					if newRatio == ratio && (diffwidth < bestCropSetWidth || diffHeight < bestCropSetHeight) {
-						pd.log("picked cropset processing option 1-init")
-						bestCropSet = imgs[i].virtualImageParams[j]
-						bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-						bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-						bestImgRatio = math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					} else if newRatio == ratio && bestImgRatio != ratio {
-						pd.log("picked cropset processing option 2-init: newRatio=" + floatToString(newRatio) + ", bestImgRatio=" + floatToString(bestImgRatio) + ", ratio=" + floatToString(ratio))
-						bestCropSet = imgs[i].virtualImageParams[j]
-						bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-						bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-						bestImgRatio = math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					} else if bestImgRatio != ratio && diffwidth < bestCropSetWidth && diffHeight < bestCropSetHeight {
-						pd.log("picked cropset processing option 3-init")
-						bestCropSet = imgs[i].virtualImageParams[j]
-						bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-						bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-						bestImgRatio = math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					}
-				}
-			}
-		} else {
-			if len(imgs[i].virtualImageParams) > 0 {
-				bestCropSet = imgs[i].virtualImageParams[0]
-				pd.log("best crop called: ch=" + uintToString(bestCropSet.cropSizeHeight) + ", cw=" + uintToString(bestCropSet.cropSizeWeight) + ", x=" + intToString(bestCropSet.topLeftX) + ", y=" + intToString(bestCropSet.topLeftY))
-				bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-				bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-				bestImgRatio = math.Floor((float64(bestImg.imageAssetRefs[0].width) / float64(bestImg.imageAssetRefs[0].height)) * 10)
-
-				for j := 0; j < len(bestImg.virtualImageParams); j++ {
-					newRatio := math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					diffwidth := math.Abs(float64(pd.cw - imgs[i].virtualImageParams[j].cropSizeWeight))
-					diffHeight := math.Abs(float64(pd.ch - imgs[i].virtualImageParams[j].cropSizeHeight))
-					pd.log("original ratio: " + floatToString(ratio) + ", new ratio: " + floatToString(newRatio))
-					if newRatio == ratio && (diffwidth < bestCropSetWidth || diffHeight < bestCropSetHeight) {
-						pd.log("picked cropset processing option 1")
-						bestCropSet = imgs[i].virtualImageParams[j]
-						bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-						bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-						bestImgRatio = math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					} else if newRatio == ratio && bestImgRatio != ratio {
-						pd.log("picked cropset processing option 2: newRatio=" + floatToString(newRatio) + ", bestImgRatio=" + floatToString(bestImgRatio) + ", ratio=" + floatToString(ratio))
-						bestCropSet = imgs[i].virtualImageParams[j]
-						bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-						bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-						bestImgRatio = math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					} else if bestImgRatio != ratio && diffwidth < bestCropSetWidth && diffHeight < bestCropSetHeight {
-						pd.log("picked cropset processing option 3")
-						bestCropSet = imgs[i].virtualImageParams[j]
-						bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-						bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-						bestImgRatio = math.Floor((float64(imgs[i].virtualImageParams[j].cropSizeWeight) / float64(imgs[i].virtualImageParams[j].cropSizeHeight)) * 10)
-					}
-				}
-			} else {
-				//image has no crop sets
-				newRatio := math.Floor((float64(imgs[i].imageAssetRefs[0].width) / float64(imgs[i].imageAssetRefs[0].height)) * 10)
-				diffwidth := math.Abs(float64(pd.cw - imgs[i].imageAssetRefs[0].width))
-				diffHeight := math.Abs(float64(pd.ch - imgs[i].imageAssetRefs[0].height))
-				pd.log("Image has no crop sets newRatio=" + floatToString(newRatio) + ", ratio=" + floatToString(ratio) + ", diffWidth=" + floatToString(diffwidth) + ", bestCropSetWidth=" + floatToString(bestCropSetWidth) + ", diffHeight=" + floatToString(diffHeight) + ", bestCropSetHeight=" + floatToString(bestCropSetHeight))
-				pd.log("checking image asset ref details to check ratio")
-				if newRatio == ratio && (diffwidth < bestCropSetWidth || diffHeight < bestCropSetHeight) {
-					pd.log("processing b-1")
-					bestImg = imgs[i]
-					bestCropSetWidth = math.Abs(float64(pd.cw - bestImg.imageAssetRefs[0].width))
-					bestCropSetHeight = math.Abs(float64(pd.ch - bestImg.imageAssetRefs[0].height))
-					bestImgRatio = math.Floor((float64(bestImg.imageAssetRefs[0].width) / float64(bestImg.imageAssetRefs[0].height)) * 10)
-				} else if newRatio == ratio && bestImgRatio != ratio {
-					pd.log("processing option b-2: newRatio=" + floatToString(newRatio) + ", bestImgRatio=" + floatToString(bestImgRatio) + ", ratio=" + floatToString(ratio))
-					bestImg = imgs[i]
-					bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-					bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-					bestImgRatio = math.Floor((float64(bestImg.imageAssetRefs[0].width) / float64(bestImg.imageAssetRefs[0].height)) * 10)
-				} else if bestImgRatio != ratio && diffwidth < bestCropSetWidth && diffHeight < bestCropSetHeight {
-					pd.log("processing b-3")
-					bestImg = imgs[i]
-					bestCropSetWidth = math.Abs(float64(pd.cw - bestCropSet.cropSizeWeight))
-					bestCropSetHeight = math.Abs(float64(pd.ch - bestCropSet.cropSizeHeight))
-					bestImgRatio = math.Floor((float64(bestImg.imageAssetRefs[0].width) / float64(bestImg.imageAssetRefs[0].height)) * 10)
-				}
-			}
+		pd.log("Image path: " + id + ", params: " + nv)
+		if err := findParams(nv, id, pd); err != nil {
+			return "", err
 		}
+		return id, nil
 	}
 
-	pd.log("By Id best img uri found was: " + bestImg.imageAssetRefs[0].uri)
-	if bestCropSet.cropSizeWeight > 0 {
-		pd.log("Best virtual cropset found w:" + uintToString(bestCropSet.cropSizeWeight) + ", h:" + uintToString(bestCropSet.cropSizeHeight) + ", x:" + intToString(bestCropSet.topLeftX) + ", y:" + intToString(bestCropSet.topLeftY))
-		return bestImg.imageAssetRefs[0].uri, bestCropSet.cropSizeWeight, bestCropSet.cropSizeHeight, bestCropSet.topLeftX, bestCropSet.topLeftY
-	}
-	return bestImg.imageAssetRefs[0].uri, 0, 0, 0, 0
-}
-
-func generateImage(pd *parametersData, ah string, po string, idflag bool) ([]byte, string) {
-	//remove the original prefix of the path which is always 5 characters as it's uri/
-	//path to image
-	var p string
-	//mgid
 	var id string
-	//crop width
-	var cw uint
-	//crop height
-	var ch uint
-	//crop offset x
-	var cx int
-	//crop offset y
-	var cy int
-	//full request path
-	var fp string
-
 	switch strings.Index(po, "mgid:") {
 	default:
 		pd.log("Params found for path: " + po)
 		//has parameters
 		mi := strings.Index(po, "/")
+		if mi == -1 {
+			//the parameters run into the mgid without a slash between them
+			pd.log("400: Missing / between the parameters and mgid: " + po)
+			return "", newImageError(errKindBadParams, "Invalid parameters", nil)
+		}
 		nv := po[:mi]
 		id = po[mi+1:]
 		//parse params
 		pd.log("index: " + intToString(mi) + ", mgid: " + id + ", params: " + nv)
-		findParams(nv, id, pd)
+		if err := findParams(nv, id, pd); err != nil {
+			return "", err
+		}
 	case -1:
 		pd.log("404: Invalid image request")
-		return nil, ""
+		return "", newImageError(errKindNotFound, "Invalid image request", nil)
 	case 0:
 		pd.log("No params found for path: " + po)
 		id = po
 	}
+	id, err := url.PathUnescape(id)
+	if err != nil {
+		pd.log("404: Invalid image path encoding")
+		return "", newImageError(errKindNotFound, "Invalid image request", nil)
+	}
+	return id, nil
+}
 
-	//init image magic wand (sets up new image conversion)
-	mw := imagick.NewMagickWand()
-
-	//handle logic for fetching image by item id or by image mgid
-	//TODO: refactor me
-	if idflag == true {
-		id, cw, ch, cx, cy = getBestImageByMgidID(id, pd)
-		p = strings.Replace(id, ":", "_", -1)
-		if cw > 0 && ch > 0 {
-			pd.cw = cw
-			pd.ch = ch
-			pd.cx = cx
-			pd.cy = cy
-		}
-
-		if id == "" || p == "" {
-			//no image found so return missing image
-			loadMissingImage(mw, pd)
-			fp = imgBaseDir + imageNotFoundPath
-		} else {
-			fp = imgBaseDir + p
-		}
-		pd.log("File Path: " + fp)
-	} else {
-		p = strings.Replace(id, ":", "_", -1)
-
-		if p == "" {
-			pd.log("Invalid id requested: " + id)
-			return nil, ""
-		}
+// loadImage returns the image for the mgid string or relative path id and its local file path.
+// The image is read from the local volume or fetched from the origin and saved there for next time.
+func loadImage(id string, pd *parametersData) ([]byte, string, error) {
+	p := strings.Replace(id, ":", "_", -1)
 
-		fp = imgBaseDir + p
-		pd.log("File Path: " + fp)
+	if p == "" || hasDotDot(p) {
+		//ids come from the url so .. could walk the local path out of the image folder
+		pd.log("Invalid id requested: " + id)
+		return nil, "", newImageError(errKindNotFound, "Invalid image request", nil)
 	}
 
+	fp := imgBaseDir + p
+	pd.log("File Path: " + fp)
+
 	if pd.cacheRefresh {
 		crerr := os.Remove(fp)
 		if crerr != nil {
@@ -682,71 +663,252 @@ func generateImage(pd *parametersData, ah string, po string, idflag bool) ([]byt
 	}
 	//check if the file exists
 	i, err := ioutil.ReadFile(fp)
-	if err != nil {
+	if err == nil {
+		pd.log("Found image locally: " + fp)
+		return i, fp, nil
+	}
+	if pd.cacheRefresh {
+		//refreshes fetch without the lock so they must leave any other server's lock alone
+		i, err = fetchRemoteImageURL(id, p, pd)
+	} else if tok, ok := setImageFetchLock(fp, pd); ok {
 		//file not found locally fetch remote
-		//see if any other process is fetching the image.  if so then return 404 for now.
-		if pd.cacheRefresh || setImageFetchLock(fp, pd) {
-			fetchRemoteImageURL(id, p, pd, mw)
-		} else {
-			loadMissingImage(mw, pd)
-			fp = imgBaseDir + imageNotFoundPath
+		i, err = fetchRemoteImageURL(id, p, pd)
+		releaseImageFetchLock(fp, tok, pd)
+	} else {
+		//another server is fetching the image so wait for it to finish
+		i, err = waitForImageFetch(id, p, fp, pd)
+	}
+	return i, fp, err
+}
+
+// hasDotDot reports whether any segment of the slash separated path p is ..
+func hasDotDot(p string) bool {
+	for _, s := range strings.Split(p, "/") {
+		if s == ".." {
+			return true
 		}
 	}
-	if err == nil {
-		pd.log("Found image locally: " + fp)
-		mw.ReadImageBlob(i)
+	return false
+}
+
+// resolveImageID returns the image mgid for the requested id.
+// /oid/ ids are looked up in arc which also gives the crop set and focal point of the best image.
+func resolveImageID(id string, rt routeType, pd *parametersData) (string, error) {
+	if rt != routeOID {
+		return id, nil
+	}
+	id, cw, ch, cx, cy, fpt, err := getBestImageByMgidID(id, pd)
+	if err != nil {
+		fmt.Println("Failed to find image by id: ", err)
+		pd.log("Failed to find image by id: " + err.Error())
+		return "", err
+	}
+	if cw > 0 && ch > 0 {
+		pd.CW = cw
+		pd.CH = ch
+		pd.CX = cx
+		pd.CY = cy
+	}
+	if fpt != nil && !pd.Focal && pd.CG == "" {
+		//crop around the subject instead of the top left of the crop set
+		pd.log("Using arc focal point x=" + floatToString(fpt.X) + ", y=" + floatToString(fpt.Y))
+		pd.FX, pd.FY, pd.Focal = fpt.X, fpt.Y, true
+	}
+	return id, nil
+}
+
+// generateImage builds the requested image returning the image bytes and format.
+// id and pd come from parseImagePath.
+// When the error is not nil the bytes may still hold the default image to serve with the error status.
+func generateImage(pd *parametersData, ah string, id string, rt routeType) ([]byte, string, error) {
+	//full request path
+	var fp string
+
+	//an unknown watermark is a bad request so find out before fetching and rendering the image
+	var wm *imagick.MagickWand
+	if pd.WM != "" {
+		var werr error
+		wm, werr = loadWatermark(pd)
+		if werr != nil {
+			pd.log("Failed to load watermark: " + werr.Error())
+			return nil, "", werr
+		}
+		defer wm.Destroy()
+	}
+
+	id, ierr := resolveImageID(id, rt, pd)
+
+	var i []byte
+	if ierr == nil {
+		i, fp, ierr = loadImage(id, pd)
+	}
+
+	if ierr != nil {
+		ie := toImageError(ierr)
+		if !ie.fallback() {
+			return nil, "", ie
+		}
+		//serve the default image along with the error status
+		var err error
+		i, err = loadMissingImage(pd)
+		if err != nil {
+			return nil, "", err
+		}
+		fp = imgBaseDir + imageNotFoundPath
+		ierr = ie
+	}
+
+	//init image magic wand (sets up new image conversion)
+	mw := imagick.NewMagickWand()
+	if err := mw.ReadImageBlob(i); err != nil {
+		fmt.Println("Error while reading image blob", fp, err)
+		pd.log("Error while reading image blob: " + err.Error())
+		mw.Destroy()
+		return nil, "", newImageError(errKindProcessing, "Failed to read image", err)
 	}
 
 	//get image format/extension and set it for mw
-	pd.f = getImageFormat(fp, pd.f, ah, mw.GetImageAlphaChannel(), pd)
+	pd.F = getImageFormat(fp, pd.F, ah, mw.GetImageAlphaChannel(), mw.GetNumberImages() > 1 && pd.AM != "s", pd)
 	mw.GetImageAlphaChannel()
-	pd.log("Extension is:" + pd.f + ", for path: " + fp)
-	mw.SetImageFormat(pd.f)
-	mw.SetFormat(pd.f)
+	pd.log("Extension is:" + pd.F + ", for path: " + fp)
+	mw.SetImageFormat(pd.F)
+	mw.SetFormat(pd.F)
 
 	//CoalesceImages to break image into layers.  Must be called before any image layer specific operations.
 	aw := mw.CoalesceImages()
 	mw.Destroy()
 	mw = aw
 
+	//Handle Orientation
+	for i := 0; i < int(mw.GetNumberImages()); i++ {
+		mw.SetIteratorIndex(i)
+		oerr := orientFrame(mw, pd)
+		if oerr != nil {
+			pd.log("Failed to orient image: " + oerr.Error())
+		}
+	}
+
+	//Handle Device Pixel Ratio
+	applyDPR(pd, mw.GetImageWidth(), mw.GetImageHeight())
+
+	//the dpr and the arc crop set can make the output bigger than the size checked before the image was loaded
+	if lerr := checkLimits(pd); lerr != nil {
+		mw.Destroy()
+		return nil, "", lerr
+	}
+
+	//Handle Animation Mode
+	switch pd.AM {
+	case "":
+	case "s", "p":
+		if mw.GetNumberImages() > 1 {
+			aw = getAnimationFrames(mw, pd)
+			mw.Destroy()
+			mw = aw
+		}
+	default:
+		pd.log("Unknown animation mode: " + pd.AM)
+	}
+
 	//Handle Crop
-	if pd.cw > 0 && pd.ch > 0 {
+	if pd.CW > 0 && pd.CH > 0 {
+		//the gravity offset is found on the first frame and used for every frame so animations don't jump around
+		var gx, gy int
+		//size of the first frame before cropping
+		var sw, sh uint
+		if pd.Focal {
+			mw.SetIteratorIndex(0)
+			sw, sh = mw.GetImageWidth(), mw.GetImageHeight()
+			gx, gy = focalOffset(sw, sh, pd.CW, pd.CH, pd.FX, pd.FY)
+		} else if pd.CG != "" {
+			mw.SetIteratorIndex(0)
+			gx, gy = cropOffset(mw, pd.CW, pd.CH, pd.CG, pd)
+		}
 		for i := 0; i < int(mw.GetNumberImages()); i++ {
 			mw.SetIteratorIndex(i)
-			x := pd.cx
-			y := pd.cy
-			if pd.cc {
+			x := pd.CX
+			y := pd.CY
+			if pd.Focal || pd.CG != "" {
+				x = gx
+				y = gy
+			} else if pd.CC {
 				//calculate the x and y for the offset
 				// need to fix issue with trying to do math on uint values and how to cast to int from uint
-				x = (int(mw.GetImageWidth()) - int(pd.cw)) / 2
-				y = (int(mw.GetImageHeight()) - int(pd.ch)) / 2
+				x = (int(mw.GetImageWidth()) - int(pd.CW)) / 2
+				y = (int(mw.GetImageHeight()) - int(pd.CH)) / 2
 			}
 			pd.log("Crop image: " + fp + " x=" + intToString(x) + ", y=" + intToString(y))
-			mw.CropImage(pd.cw, pd.ch, x, y)
-			mw.SetImagePage(pd.cw, pd.ch, 0, 0)
+			mw.CropImage(pd.CW, pd.CH, x, y)
+			//only the part of the crop inside the frame is kept
+			mw.SetImagePage(mw.GetImageWidth(), mw.GetImageHeight(), 0, 0)
+		}
+		if pd.Focal {
+			//fit=cover places its crop by the focal point again so move it from the source onto the cropped frame
+			mw.SetIteratorIndex(0)
+			pd.FX = math.Max(0, math.Min(1, (pd.FX*float64(sw)-float64(gx))/float64(mw.GetImageWidth())))
+			pd.FY = math.Max(0, math.Min(1, (pd.FY*float64(sh)-float64(gy))/float64(mw.GetImageHeight())))
+			pd.log("Focal point in the crop x=" + floatToString(pd.FX) + ", y=" + floatToString(pd.FY))
 		}
 	}
 
 	//Handle Resize
-	if pd.rw > 0 || pd.rh > 0 {
+	if pd.RW > 0 || pd.RH > 0 {
 		for i := 0; i < int(mw.GetNumberImages()); i++ {
 			mw.SetIteratorIndex(i)
-			x := mw.GetImageWidth()
-			y := mw.GetImageHeight()
-			ratio := uint((float64(x) / float64(y)) * 100)
-			if pd.rw > 0 && pd.rh == 0 {
-				x = pd.rw
-				y = (pd.rw * ratio) / 100
+			rerr := resizeFrame(mw, pd)
+			if rerr != nil {
+				pd.log("Failed to resize image: " + rerr.Error())
 			}
-			if pd.rh > 0 && pd.rw == 0 {
-				x = (pd.rh * ratio / 100)
-				y = pd.rh
+		}
+	}
+
+	//Handle Effects
+	if pd.hasEffects() {
+		for i := 0; i < int(mw.GetNumberImages()); i++ {
+			mw.SetIteratorIndex(i)
+			eerr := applyEffects(mw, pd)
+			if eerr != nil {
+				pd.log("Failed to apply effects: " + eerr.Error())
+			}
+		}
+	}
+
+	//Handle Text
+	//the lines are wrapped on the first frame and drawn the same on every frame
+	//the default image served for errors is left alone
+	if pd.Txt != "" && ierr == nil {
+		mw.SetIteratorIndex(0)
+		dw, terr := newTextDrawing(mw, pd)
+		if terr != nil {
+			pd.log("Failed to set up text: " + terr.Error())
+		} else {
+			for i := 0; i < int(mw.GetNumberImages()); i++ {
+				mw.SetIteratorIndex(i)
+				terr = mw.DrawImage(dw)
+				if terr != nil {
+					pd.log("Failed to draw text: " + terr.Error())
+				}
 			}
-			tierr := mw.ThumbnailImage(x, y)
-			if tierr != nil {
-				pd.log("Failed to create thumbnail image: " + tierr.Error())
+			dw.Destroy()
+		}
+	}
+
+	//Handle Watermark
+	//the default image served for errors is left alone
+	if wm != nil && ierr == nil {
+		mw.SetIteratorIndex(0)
+		werr := scaleWatermark(wm, mw.GetImageWidth(), mw.GetImageHeight(), pd)
+		if werr != nil {
+			pd.log("Failed to scale watermark: " + werr.Error())
+			mw.Destroy()
+			return nil, "", werr
+		}
+		for i := 0; i < int(mw.GetNumberImages()); i++ {
+			mw.SetIteratorIndex(i)
+			werr = watermarkFrame(mw, wm, pd)
+			if werr != nil {
+				pd.log("Failed to apply watermark: " + werr.Error())
 			}
-			mw.SetImagePage(pd.rw, pd.rh, 0, 0)
 		}
 	}
 
@@ -756,7 +918,7 @@ func generateImage(pd *parametersData, ah string, po string, idflag bool) ([]byt
 	mw = aw
 
 	//Handle Normalize
-	if pd.n {
+	if pd.N {
 		mw.NormalizeImage()
 	}
 
@@ -768,22 +930,24 @@ func generateImage(pd *parametersData, ah string, po string, idflag bool) ([]byt
 	mw.SetOption("png:exclude-chunk", "all")
 	mw.SetColorspace(imagick.COLORSPACE_SRGB)
 	// mw.SetInterlaceScheme(imagick.INTERLACE_NO)
-	// mw.SharpenImage(0.25, 0.25)
 	// mw.PosterizeImage(136, false)
 
 	//Handle Quality
-	if pd.q > 0 {
-		switch pd.f {
+	if pd.Q > 0 {
+		switch pd.F {
 		case "png":
 			// the image format is a pain so please don't use it if possible
 			mw.SetImageCompression(imagick.COMPRESSION_LOSSLESS_JPEG)
-			mw.SetImageCompressionQuality(pd.q)
+			mw.SetImageCompressionQuality(pd.Q)
 		case "webp":
 			mw.SetImageCompression(imagick.COMPRESSION_LOSSLESS_JPEG)
-			mw.SetImageCompressionQuality(pd.q)
+			mw.SetImageCompressionQuality(pd.Q)
 		case "jpg":
 			mw.SetImageCompression(imagick.COMPRESSION_JPEG)
-			mw.SetImageCompressionQuality(pd.q)
+			mw.SetImageCompressionQuality(pd.Q)
+		case "avif", "jxl":
+			//q is given on the jpeg scale so map it to the same visual quality for the newer encoders
+			mw.SetImageCompressionQuality(formatQuality(pd.F, pd.Q))
 		}
 	}
 
@@ -791,11 +955,16 @@ func generateImage(pd *parametersData, ah string, po string, idflag bool) ([]byt
 
 	ib := mw.GetImageBlob()
 	mw.Destroy()
-	return ib, pd.f
+	if len(ib) == 0 {
+		return nil, "", newImageError(errKindProcessing, "Failed to create image", nil)
+	}
+	return ib, pd.F, ierr
 }
 
-func outputDebug(w http.ResponseWriter, pd *parametersData) {
+// outputDebug sends the messages logged for the request instead of the image with the status code
+func outputDebug(w http.ResponseWriter, pd *parametersData, code int) {
 	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(code)
 	t := "<html><body><h1>Debug Output:</h1>"
 	for _, v := range pd.msgs {
 		t += "<li>" + v + "</li>"
@@ -804,15 +973,85 @@ func outputDebug(w http.ResponseWriter, pd *parametersData) {
 	fmt.Fprint(w, t)
 }
 
+// routeType is the kind of image path a handler serves
+type routeType int
+
+const (
+	//uri/{params}/{image mgid string}
+	routeURI routeType = iota
+	//oid/{params}/{object mgid string}
+	routeOID
+	//img/{params}/{relative image path}
+	routePath
+)
+
+// prefix is the route the handler is registered on without slashes
+func (rt routeType) prefix() string {
+	switch rt {
+	case routeOID:
+		return "oid"
+	case routePath:
+		return "img"
+	}
+	return "uri"
+}
+
+// cacheKey is the redis key for a transformed image built from the parsed request rather than the raw path,
+// so parameter order and number formats don't matter and the format picked from the accept header is part of the key
+func cacheKey(rt routeType, id string, pd *parametersData, ah string) string {
+	of := negotiateFormat(pd.F, ah)
+	switch {
+	case of == "":
+		//picked from the source image so it is the same for every request
+		of = "auto"
+	case pd.F == "" && !animatedFormats[of]:
+		//animated sources get a format that depends on the accept header too
+		of += "," + animatedFallback(ah)
+	}
+	return rt.prefix() + "/" + pd.String() + "/" + id + "/" + of
+}
+
+// writeImage sends the image with caching headers answering conditional requests with a 304.
+// mt is when the image was generated and vary lists the request headers that picked the image.
+func writeImage(w http.ResponseWriter, r *http.Request, i []byte, f string, mt time.Time, vary []string) {
+	sum := sha256.Sum256(i)
+	w.Header().Set("Content-Type", "image/"+f)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(cacheMaxAge/time.Second), 10))
+	if len(vary) > 0 {
+		//a different request header can get a different image for the same url
+		w.Header().Set("Vary", strings.Join(vary, ", "))
+	}
+	//handles If-None-Match and If-Modified-Since
+	http.ServeContent(w, r, "", mt, bytes.NewReader(i))
+}
+
+// writeJSON sends v as json with the same caching as images
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(cacheMaxAge/time.Second), 10))
+	json.NewEncoder(w).Encode(v)
+}
+
 func handlerImageURI(w http.ResponseWriter, r *http.Request) {
+	serveImage(w, r, routeURI)
+}
+
+func handlerImageID(w http.ResponseWriter, r *http.Request) {
+	serveImage(w, r, routeOID)
+}
+
+func handlerImagePath(w http.ResponseWriter, r *http.Request) {
+	serveImage(w, r, routePath)
+}
+
+func serveImage(w http.ResponseWriter, r *http.Request, rt routeType) {
 	//params init
 	var pd parametersData
 	var i []byte
-	var err error
 	var f string
-	var cc *redis.StringCmd
-	pd.cc = false
-	pd.n = false
+	pd.CC = false
+	pd.N = false
 
 	qs := r.URL.Query()
 
@@ -822,152 +1061,153 @@ func handlerImageURI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, pd.cacheRefresh = qs["cacheRefresh"]
-	_, pd.debug = qs["debug"]
-
-	//check to see if the image is in redis cache
-	if pd.cacheRefresh == false {
-		cc = redisClient.Get(redisKeyCachePrefix + r.URL.Path)
-		i, err = cc.Bytes()
-	}
-
-	if i != nil {
-		pd.log("Image cache found for: " + r.URL.Path)
-		cc = redisClient.Get(redisKeyCacheFormatPrefix + r.URL.Path)
-		if pd.debug {
-			pd.log("Expires in: " + redisClient.TTL(redisKeyCacheFormatPrefix+r.URL.Path).Val().String())
-		}
-		f = cc.Val()
-		if f == "" {
-			pd.log("Error while retrieving cache data for redis: " + err.Error())
-			//setting i to nil to force the image generation because we didn't get a format for the image cache
-			i = nil
-		}
+	pd.ctx = r.Context()
+	if len(signingSecret) == 0 {
+		//anyone could add the query string to a signed url so signed urls need the signed parameter instead
+		_, pd.cacheRefresh = qs[refreshParam]
 	}
+	_, pd.debug = qs["debug"]
 
-	//if not then create the image
-	if i == nil {
-		pd.log("Generating image for " + r.URL.Path)
-		//remove the original prefix of the path which is always 5 characters as it's uri/
-		i, f = generateImage(&pd, r.Header.Get("Accept"), r.URL.Path[5:], false)
-		//add to redis cache
-		scf := redisClient.Set(redisKeyCacheFormatPrefix+r.URL.Path, f, imageCacheTimeout)
-		if scf.Err() != nil {
-			//failed to save the image cache to redis
-			pd.log("Failed to save an image format to redis cache: " + r.URL.Path + ", Error: " + scf.Err().Error())
-			//skipping error as we can still survive
-		}
-
-		if scf.Err() == nil {
-			scc := redisClient.Set(redisKeyCachePrefix+r.URL.Path, i, imageCacheTimeout)
-			if scc.Err() != nil {
-				//failed to save the image cache to redis
-				pd.log("Failed to save an image to redis cache: " + r.URL.Path + ", Error: " + scc.Err().Error())
-				//skipping error as we can still survive
-			}
-		}
-	}
+	//the path is kept encoded until the parameters are split so text values can hold : and =
+	po := r.URL.EscapedPath()
 
-	//everything failed check
-	if i == nil {
-		//need to have a better error handling here, at least set 404 but this should only occur when the default img is not working
+	if !verifySignature(rt.prefix(), po[5:], &pd) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
 		return
 	}
 
-	if pd.debug {
-		outputDebug(w, &pd)
+	//remove the original prefix of the path which is always 5 characters as it's uri/, oid/ or img/
+	id, perr := parseImagePath(po[5:], rt, &pd)
+	if perr != nil {
+		writeRequestError(w, &pd, perr)
 		return
 	}
-	w.Header().Set("Content-Type", "image/"+f)
-	w.Write(i)
-}
 
-func handlerImageID(w http.ResponseWriter, r *http.Request) {
-	//params init
-	var pd parametersData
-	var i []byte
-	var err error
-	var f string
-	var cc *redis.StringCmd
-	pd.cc = false
-	pd.n = false
-
-	qs := r.URL.Query()
+	//client hints give the dpr unless the url has one
+	pd.dprParam = pd.DPR > 0
+	if !pd.dprParam {
+		pd.DPR = headerDPR(r)
+	}
 
-	if _, ok := qs["help"]; ok {
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintln(w, helpMsg)
+	if lerr := checkLimits(&pd); lerr != nil {
+		writeRequestError(w, &pd, lerr)
 		return
 	}
 
-	_, pd.cacheRefresh = qs["cacheRefresh"]
-	_, pd.debug = qs["debug"]
+	ah := r.Header.Get("Accept")
+	k := cacheKey(rt, id, &pd, ah)
+	pd.log("Cache key: " + k)
+	var vary []string
+	if pd.F == "" {
+		//the format is only fixed when requested, otherwise it depends on the accept header
+		vary = append(vary, "Accept")
+	}
+	if !pd.dprParam {
+		vary = append(vary, "Sec-CH-DPR", "DPR")
+	}
+	mt := time.Now()
 
 	//check to see if the image is in redis cache
 	if pd.cacheRefresh == false {
-		cc = redisClient.Get(redisKeyCachePrefix + r.URL.Path)
-		i, err = cc.Bytes()
+		i, _ = redisClient.Get(redisKeyCachePrefix + k).Bytes()
 	}
 
 	if i != nil {
-		pd.log("Image cache found for " + r.URL.Path)
-		cc = redisClient.Get(redisKeyCacheFormatPrefix + r.URL.Path)
+		pd.log("Image cache found for: " + k)
+		cc := redisClient.Get(redisKeyCacheFormatPrefix + k)
+		if pd.debug {
+			pd.log("Expires in: " + redisClient.TTL(redisKeyCacheFormatPrefix+k).Val().String())
+		}
 		f = cc.Val()
+		if cm, err := redisClient.Get(redisKeyCacheModifiedPrefix + k).Int64(); err == nil {
+			mt = time.Unix(cm, 0)
+		}
 		if f == "" {
-			pd.log("Error while retrieving cache data for redis: " + err.Error())
+			if cc.Err() != nil {
+				pd.log("Error while retrieving cache data for redis: " + cc.Err().Error())
+			}
 			//setting i to nil to force the image generation because we didn't get a format for the image cache
 			i = nil
 		}
 	}
 
 	//if not then create the image
+	var gerr error
 	if i == nil {
-		pd.log("Fetching image information")
-
 		pd.log("Generating image for " + r.URL.Path)
-		//remove the original prefix of the path which is always 5 characters as it's uri/
-		i, f = generateImage(&pd, r.Header.Get("Accept"), r.URL.Path[5:], true)
-		//add to redis cache
-		scf := redisClient.Set(redisKeyCacheFormatPrefix+r.URL.Path, f, imageCacheTimeout)
-		if scf.Err() != nil {
-			//failed to save the image cache to redis
-			fmt.Println("Failed to save an image format to redis cache", r.URL.Path, scf.Err())
-			pd.log("Failed to save an image format to redis cache: " + r.URL.Path + ", Error: " + scf.Err().Error())
-			//skipping error as we can still survive
-		}
-
-		if scf.Err() == nil {
-			scc := redisClient.Set(redisKeyCachePrefix+r.URL.Path, i, imageCacheTimeout)
-			if scc.Err() != nil {
+		gen := func() ([]byte, string, error) {
+			return generateImage(&pd, ah, id, rt)
+		}
+		if pd.debug || pd.cacheRefresh {
+			//debug needs its own log and cache refresh must not be answered by a request already in flight
+			i, f, gerr = gen()
+		} else {
+			//concurrent identical requests share one image generation
+			var shared bool
+			i, f, shared, gerr = imageCalls.do(pd.ctx, k, gen)
+			if shared {
+				pd.log("Shared in flight image generation for " + k)
+			}
+		}
+		if gerr != nil {
+			fmt.Println("Failed to generate image: ", r.URL.Path, gerr)
+			pd.log("Failed to generate image: " + gerr.Error())
+		} else {
+			//add to redis cache, errors aren't cached so the next request tries again
+			scf := redisClient.Set(redisKeyCacheFormatPrefix+k, f, imageCacheTimeout)
+			if scf.Err() != nil {
 				//failed to save the image cache to redis
-				fmt.Println("Failed to save an image to redis cache", r.URL.Path, scc.Err())
+				fmt.Println("Failed to save an image format to redis cache", k, scf.Err())
+				pd.log("Failed to save an image format to redis cache: " + k + ", Error: " + scf.Err().Error())
 				//skipping error as we can still survive
 			}
+
+			redisClient.Set(redisKeyCacheModifiedPrefix+k, mt.Unix(), imageCacheTimeout)
+
+			if scf.Err() == nil {
+				scc := redisClient.Set(redisKeyCachePrefix+k, i, imageCacheTimeout)
+				if scc.Err() != nil {
+					//failed to save the image cache to redis
+					fmt.Println("Failed to save an image to redis cache", k, scc.Err())
+					pd.log("Failed to save an image to redis cache: " + k + ", Error: " + scc.Err().Error())
+					//skipping error as we can still survive
+				}
+			}
 		}
 	}
 
-	//everything failed check
-	if i == nil {
-		//need to have a better error handling here, at least set 404 but this should only occur when the default img is not working
-		pd.log("No image data found due to missing default image")
-		if pd.debug == false {
-			return
+	if pd.debug {
+		//the status is the one the image would have been served with
+		code := http.StatusOK
+		if gerr != nil {
+			code = toImageError(gerr).status()
 		}
+		outputDebug(w, &pd, code)
+		return
 	}
 
-	if pd.debug {
-		outputDebug(w, &pd)
+	if gerr != nil {
+		ie := toImageError(gerr)
+		if i == nil {
+			writeError(w, ie)
+			return
+		}
+		//default image served with the error status
+		w.Header().Set("Content-Type", "image/"+f)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(ie.status())
+		w.Write(i)
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/"+f)
-	w.Write(i)
+	writeImage(w, r, i, f, mt, vary)
 }
 
 func main() {
-	remoteImgURL = os.Getenv("REMOTE_IMG_URL")
-	if remoteImgURL == "" {
-		fmt.Println("Missing environment variable REMOTE_IMG_URL which should point to the remote base url to pass the requested paths onto")
+	var err error
+	imageOrigin, err = newOrigin()
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 	imgBaseDir = os.Getenv("IMG_PATH")
@@ -988,6 +1228,62 @@ func main() {
 	}
 	imageIDQuery = imgIDDomain + imageIDQueryString
 
+	signingSecret = []byte(os.Getenv("URL_SIGNING_SECRET"))
+
+	err = initManifest()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = initPresets()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = initText()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if wp, ok := os.LookupEnv("WATERMARK_PREFIX"); ok {
+		watermarkPrefix = wp
+	}
+
+	err = initHTTPClient()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	//fetch locks have to outlast the slowest fetch or a second server starts the same fetch
+	imageFetchTimeout = fetchBudget() + time.Second
+	lockWaitTimeout, err = envDuration("LOCK_WAIT_TIMEOUT", imageFetchTimeout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cacheMaxAge, err = envDuration("CACHE_MAX_AGE", cacheMaxAge)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = initLimits()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = initFormats()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	imagick.Initialize()
 	//defer imagick.Terminate()
 
@@ -1006,6 +1302,9 @@ func main() {
 
 	http.HandleFunc("/uri/", handlerImageURI)
 	http.HandleFunc("/oid/", handlerImageID)
+	http.HandleFunc("/img/", handlerImagePath)
+	http.HandleFunc("/manifest/", handlerManifest)
+	http.HandleFunc("/info/", handlerInfo)
 	http.HandleFunc("/", handlerHelp)
 	http.ListenAndServe(":8080", nil)
 }
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestLoadImageTraversal(t *testing.T) {
+	b := imgBaseDir
+	imgBaseDir = t.TempDir() + "/"
+	defer func() { imgBaseDir = b }()
+
+	for _, id := range []string{
+		"mgid:file:gsp:entertainment-assets:/../../../etc/passwd",
+		"../etc/passwd",
+		"watermarks/../../logo.png",
+		"..",
+	} {
+		var pd parametersData
+		i, fp, err := loadImage(id, &pd)
+		if err == nil || toImageError(err).kind != errKindNotFound || i != nil || fp != "" {
+			t.Errorf("loadImage(%q) = %d bytes, %q, %v, want a not found error", id, len(i), fp, err)
+		}
+	}
+}
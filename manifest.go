@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jsaterfiel/go-imagick/signature"
+	"github.com/jsaterfiel/go-imagick/transform"
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// widths listed by /manifest/ for every format, set with MANIFEST_WIDTHS
+var manifestWidths = []uint{320, 480, 640, 960, 1280, 1920}
+
+// formats listed by /manifest/ in order of preference, set with MANIFEST_FORMATS
+var manifestFormats = []string{"avif", "webp", "jpg"}
+
+// manifest lists the urls of an image at every manifest width and format
+type manifest struct {
+	//size of the upright source image
+	Width    uint              `json:"width"`
+	Height   uint              `json:"height"`
+	Variants []manifestVariant `json:"variants"`
+	//srcset attribute value for each format
+	Srcset map[string]string `json:"srcset"`
+}
+
+// manifestVariant is one url of the manifest with the size it will be rendered at
+type manifestVariant struct {
+	URL    string `json:"url"`
+	Width  uint   `json:"width"`
+	Height uint   `json:"height"`
+	Format string `json:"format"`
+	Type   string `json:"type"`
+}
+
+// initManifest reads the manifest variants from the environment variables
+// MANIFEST_WIDTHS - comma separated widths in pixels, defaults to 320,480,640,960,1280,1920
+// MANIFEST_FORMATS - comma separated formats, defaults to avif,webp,jpg
+func initManifest() error {
+	if v := os.Getenv("MANIFEST_WIDTHS"); v != "" {
+		manifestWidths = nil
+		for _, s := range strings.Split(v, ",") {
+			w, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+			if err != nil || w == 0 {
+				return fmt.Errorf("Invalid environment variable MANIFEST_WIDTHS %s, must be comma separated widths in pixels", v)
+			}
+			manifestWidths = append(manifestWidths, uint(w))
+		}
+	}
+	if v := os.Getenv("MANIFEST_FORMATS"); v != "" {
+		manifestFormats = nil
+		for _, s := range strings.Split(v, ",") {
+			var t transform.Transform
+			if err := t.Parse("f=" + strings.TrimSpace(s)); err != nil {
+				return fmt.Errorf("Invalid environment variable MANIFEST_FORMATS %s, %s", v, err)
+			}
+			manifestFormats = append(manifestFormats, t.F)
+		}
+	}
+	return nil
+}
+
+// handlerManifest serves /manifest/{params}/{mgid} listing the /uri/ urls of the image at every manifest width and format.
+// Arc mgids get /oid/ urls.  The sizes are worked out from the source size without rendering anything.
+// When URL_SIGNING_SECRET is set the path needs a signature made for the manifest route,
+// as the urls it lists are signed a signature for any one image url mustn't be enough to get them.
+func handlerManifest(w http.ResponseWriter, r *http.Request) {
+	var pd parametersData
+	pd.ctx = r.Context()
+	_, pd.debug = r.URL.Query()["debug"]
+
+	po := strings.TrimPrefix(r.URL.EscapedPath(), "/manifest/")
+	if !verifySignature("manifest", po, &pd) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	rt := routeURI
+	if strings.Contains(po, "mgid:arc:") {
+		rt = routeOID
+	}
+	id, err := parseImagePath(po, rt, &pd)
+	if err != nil {
+		writeRequestError(w, &pd, err)
+		return
+	}
+	//the urls carry the requested parameters not the ones filled in from arc
+	base := pd.Transform
+	base.DPR = 0
+
+	sid, err := resolveImageID(id, rt, &pd)
+	if err != nil {
+		writeRequestError(w, &pd, err)
+		return
+	}
+	i, _, err := loadImage(sid, &pd)
+	if err != nil {
+		writeRequestError(w, &pd, err)
+		return
+	}
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := mw.PingImageBlob(i); err != nil {
+		writeRequestError(w, &pd, newImageError(errKindProcessing, "Failed to read image", err))
+		return
+	}
+	sw, sh := orientedSize(mw.GetImageWidth(), mw.GetImageHeight(), mw.GetImageOrientation(), &pd)
+
+	m := manifest{Width: sw, Height: sh, Srcset: make(map[string]string)}
+	eid := (&url.URL{Path: id}).EscapedPath()
+	for _, f := range manifestFormats {
+		var ss []string
+		var lw uint
+		for _, vw := range manifestWidths {
+			t := base
+			t.RW, t.RH = vw, 0
+			if base.RW > 0 && base.RH > 0 {
+				//keep the shape of the requested box
+				t.RH = scaleDim(base.RH, float64(vw)/float64(base.RW))
+			}
+			t.F = f
+
+			vpd := pd
+			vpd.RW, vpd.RH, vpd.F, vpd.DPR = t.RW, t.RH, t.F, 0
+			if checkLimits(&vpd) != nil {
+				continue
+			}
+			x, y := outputSize(sw, sh, &vpd)
+			if x == lw {
+				//widths past what the image can be resized to come out the same
+				continue
+			}
+			lw = x
+
+			u := "/" + rt.prefix() + "/" + t.String() + "/" + eid
+			if len(signingSecret) > 0 {
+				u = signature.Path(signingSecret, rt.prefix(), t.String(), eid)
+			}
+			m.Variants = append(m.Variants, manifestVariant{URL: u, Width: x, Height: y, Format: f, Type: mimeType(f)})
+			ss = append(ss, u+" "+uintToString(x)+"w")
+		}
+		m.Srcset[f] = strings.Join(ss, ", ")
+	}
+
+	writeJSON(w, m)
+}
+
+// mimeType returns the media type of the output format f
+func mimeType(f string) string {
+	if f == "jpg" {
+		return "image/jpeg"
+	}
+	return "image/" + f
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jsaterfiel/go-imagick/signature"
+)
+
+func TestManifestSignatureRoute(t *testing.T) {
+	s := signingSecret
+	signingSecret = []byte("secret")
+	defer func() { signingSecret = s }()
+
+	id := "mgid:file:gsp:entertainment-assets:/cc/images/a.jpg"
+	for _, route := range []string{"uri", "oid", "img", "info"} {
+		u := "/manifest/" + signature.Path(signingSecret, route, "rw=480", id)[len(route)+2:]
+		w := httptest.NewRecorder()
+		handlerManifest(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("manifest signed for /%s/ = %d, want %d", route, w.Code, http.StatusForbidden)
+		}
+	}
+
+	var pd parametersData
+	p := signature.Path(signingSecret, "manifest", "rw=480", id)
+	if !verifySignature("manifest", p[len("/manifest/"):], &pd) {
+		t.Errorf("manifest signature for %s refused", p)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Origin is where original images are fetched from when they are not on the local volume.
+// key is the mgid string or relative path of the image.
+// Fetch returns the image bytes, content type and etag (empty when the origin doesn't provide one).
+type Origin interface {
+	Fetch(ctx context.Context, key string) ([]byte, string, string, error)
+}
+
+// the origin used by fetchRemoteImageURL, selected by ORIGIN_TYPE in main
+var imageOrigin Origin
+
+// httpOrigin fetches images from a remote base url such as the mtvnimages hosts
+type httpOrigin struct {
+	baseURL string
+	query   string
+}
+
+func (o *httpOrigin) Fetch(ctx context.Context, key string) ([]byte, string, string, error) {
+	u := o.baseURL + key
+	if o.query != "" {
+		u += "?" + o.query
+	}
+	b, h, err := httpGet(ctx, u)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return b, h.Get("Content-Type"), h.Get("ETag"), nil
+}
+
+// fileOrigin reads images from a local directory such as an nfs mount
+type fileOrigin struct {
+	dir string
+}
+
+func (o *fileOrigin) Fetch(_ context.Context, key string) ([]byte, string, string, error) {
+	//clean against the root so the key can never walk out of the directory
+	fp := filepath.Join(o.dir, filepath.Clean("/"+key))
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if fi.IsDir() {
+		return nil, "", "", errors.New("origin path is a directory: " + fp)
+	}
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, "", "", err
+	}
+	et := `"` + strconv.FormatInt(fi.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(fi.Size(), 36) + `"`
+	return b, mime.TypeByExtension(filepath.Ext(fp)), et, nil
+}
+
+// s3Origin reads images from an s3 compatible bucket
+type s3Origin struct {
+	bucket string
+	prefix string
+	svc    *s3.S3
+}
+
+func (o *s3Origin) Fetch(ctx context.Context, key string) ([]byte, string, string, error) {
+	out, err := o.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.prefix + key),
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer out.Body.Close()
+
+	b, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return b, aws.StringValue(out.ContentType), aws.StringValue(out.ETag), nil
+}
+
+// newOrigin builds the origin from the environment variables
+// ORIGIN_TYPE - http (default), file or s3
+// http: REMOTE_IMG_URL, REMOTE_IMG_QUERY (defaults to q=.9)
+// file: ORIGIN_PATH
+// s3: ORIGIN_S3_BUCKET, ORIGIN_S3_PREFIX, ORIGIN_S3_REGION (defaults to us-east-1), ORIGIN_S3_ENDPOINT for non aws storage
+func newOrigin() (Origin, error) {
+	switch t := os.Getenv("ORIGIN_TYPE"); t {
+	case "", "http":
+		u := os.Getenv("REMOTE_IMG_URL")
+		if u == "" {
+			return nil, errors.New("Missing environment variable REMOTE_IMG_URL which should point to the remote base url to pass the requested paths onto")
+		}
+		q, ok := os.LookupEnv("REMOTE_IMG_QUERY")
+		if !ok {
+			//by default all images are pulled with a 90% compression from the original image servers
+			q = "q=.9"
+		}
+		return &httpOrigin{baseURL: u, query: q}, nil
+	case "file":
+		d := os.Getenv("ORIGIN_PATH")
+		if d == "" {
+			return nil, errors.New("Missing environment variable ORIGIN_PATH which should point to the folder holding the original images")
+		}
+		return &fileOrigin{dir: d}, nil
+	case "s3":
+		b := os.Getenv("ORIGIN_S3_BUCKET")
+		if b == "" {
+			return nil, errors.New("Missing environment variable ORIGIN_S3_BUCKET which should be the bucket holding the original images")
+		}
+		r := os.Getenv("ORIGIN_S3_REGION")
+		if r == "" {
+			r = "us-east-1"
+		}
+		c := &aws.Config{Region: aws.String(r)}
+		if e := os.Getenv("ORIGIN_S3_ENDPOINT"); e != "" {
+			//s3 compatible storage like minio or ceph generally need path style bucket urls
+			c.Endpoint = aws.String(e)
+			c.S3ForcePathStyle = aws.Bool(true)
+		}
+		sess, err := session.NewSession(c)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Origin{bucket: b, prefix: os.Getenv("ORIGIN_S3_PREFIX"), svc: s3.New(sess)}, nil
+	default:
+		return nil, fmt.Errorf("Unknown ORIGIN_TYPE %s, must be one of http, file or s3", t)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jsaterfiel/go-imagick/transform"
+	"gopkg.in/yaml.v2"
+)
+
+// presetParam is the parameter naming a preset, eg p=card-small
+const presetParam = "p"
+
+// presetGroups are parameters that override each other.
+// When the url gives any parameter of a group the preset's values for the whole group are left out,
+// so cx and cy in the url aren't beaten by the preset's cg.
+var presetGroups = [][]string{
+	//crop placement
+	{"cg", "cc", "cx", "cy", "fx", "fy"},
+	{"fit", "pad"},
+}
+
+// presetSet holds the named parameter segments from PRESETS_FILE
+type presetSet struct {
+	mu      sync.RWMutex
+	file    string
+	presets map[string]string
+}
+
+var presets = &presetSet{}
+
+// initPresets loads the presets from the environment variable
+// PRESETS_FILE - yaml or json file mapping preset names to parameter segments, eg card-small: rw=480:rh=320:q=50
+// The file is loaded again when the server gets a SIGHUP.
+func initPresets() error {
+	presets.file = os.Getenv("PRESETS_FILE")
+	if presets.file == "" {
+		return nil
+	}
+	if err := presets.load(); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			//a bad file keeps the presets that are already loaded
+			if err := presets.load(); err != nil {
+				fmt.Println("Failed to reload presets: ", err)
+				continue
+			}
+			fmt.Println("Reloaded presets from ", presets.file)
+		}
+	}()
+	return nil
+}
+
+// load reads and validates the presets file replacing the current presets only when every preset is valid
+func (s *presetSet) load() error {
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	ps := make(map[string]string)
+	if strings.ToLower(filepath.Ext(s.file)) == ".json" {
+		err = json.Unmarshal(b, &ps)
+	} else {
+		err = yaml.Unmarshal(b, &ps)
+	}
+	if err != nil {
+		return errors.New("Invalid presets file " + s.file + ": " + err.Error())
+	}
+	for n, p := range ps {
+		var t transform.Transform
+		if err := t.Parse(p); err != nil {
+			return errors.New("Invalid preset " + n + " in " + s.file + ": " + err.Error())
+		}
+	}
+
+	s.mu.Lock()
+	s.presets = ps
+	s.mu.Unlock()
+	return nil
+}
+
+// get returns the parameter segment of the preset n
+func (s *presetSet) get(n string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.presets[n]
+	return p, ok
+}
+
+// splitPreset takes the preset parameter out of the parameter segment p returning the rest and the preset name
+func splitPreset(p string) (string, string) {
+	var n string
+	var ps []string
+	for _, v := range strings.Split(p, ":") {
+		if strings.HasPrefix(v, presetParam+"=") {
+			n = v[len(presetParam)+1:]
+			continue
+		}
+		ps = append(ps, v)
+	}
+	return strings.Join(ps, ":"), n
+}
+
+// overridePreset leaves the parameters out of the preset segment ps that the parameter segment p overrides as a group
+func overridePreset(ps string, p string) string {
+	given := make(map[string]bool)
+	for _, v := range strings.Split(p, ":") {
+		given[strings.SplitN(v, "=", 2)[0]] = true
+	}
+	drop := make(map[string]bool)
+	for _, g := range presetGroups {
+		for _, k := range g {
+			if given[k] {
+				for _, gk := range g {
+					drop[gk] = true
+				}
+				break
+			}
+		}
+	}
+	var kept []string
+	for _, v := range strings.Split(ps, ":") {
+		if !drop[strings.SplitN(v, "=", 2)[0]] {
+			kept = append(kept, v)
+		}
+	}
+	return strings.Join(kept, ":")
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestOverridePreset(t *testing.T) {
+	tests := []struct {
+		ps   string
+		p    string
+		want string
+	}{
+		{"rw=480:rh=320:q=50", "q=80", "rw=480:rh=320:q=50"},
+		{"rw=480:cg=attention", "cx=10:cy=20", "rw=480"},
+		{"cw=100:ch=100:cx=10:cy=20", "fx=0.5", "cw=100:ch=100"},
+		{"rw=480:fx=0.2:fy=0.8:cc=1", "cg=n", "rw=480"},
+		{"rw=480:rh=320:fit=cover:q=50", "pad=1", "rw=480:rh=320:q=50"},
+		{"rw=480:pad=1:cg=s", "fit=contain:q=80", "rw=480:cg=s"},
+		{"rw=480:cg=attention:fit=cover", "", "rw=480:cg=attention:fit=cover"},
+	}
+	for _, tt := range tests {
+		if got := overridePreset(tt.ps, tt.p); got != tt.want {
+			t.Errorf("overridePreset(%q, %q) = %q, want %q", tt.ps, tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jsaterfiel/go-imagick/transform"
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// orientFrame turns the current frame of mw upright from its exif orientation
+// then applies the requested rotation and flip so crop and resize work on the turned image
+func orientFrame(mw *imagick.MagickWand, pd *parametersData) error {
+	if err := mw.AutoOrientImage(); err != nil {
+		return err
+	}
+	if pd.Rot != 0 {
+		//right angles keep every pixel, any other angle grows the canvas which is filled with the background color
+		pw := imagick.NewPixelWand()
+		defer pw.Destroy()
+		pw.SetColor(backgroundColor(mw, pd))
+		if err := mw.RotateImage(pw, pd.Rot); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(pd.Flip, "h") {
+		if err := mw.FlopImage(); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(pd.Flip, "v") {
+		if err := mw.FlipImage(); err != nil {
+			return err
+		}
+	}
+	return mw.SetImagePage(mw.GetImageWidth(), mw.GetImageHeight(), 0, 0)
+}
+
+// orientedSize returns the size orientFrame turns a w by h image with the exif orientation o into
+func orientedSize(w uint, h uint, o imagick.OrientationType, pd *parametersData) (uint, uint) {
+	if o >= imagick.ORIENTATION_LEFT_TOP {
+		//the exif orientations from 5 to 8 turn the image on its side
+		w, h = h, w
+	}
+	if pd.Rot != 0 {
+		//the bounding box of the turned image
+		r := pd.Rot * math.Pi / 180
+		sin, cos := math.Abs(math.Sin(r)), math.Abs(math.Cos(r))
+		w, h = uint(float64(w)*cos+float64(h)*sin+0.5), uint(float64(w)*sin+float64(h)*cos+0.5)
+	}
+	return w, h
+}
+
+// headerDPR returns the device pixel ratio from the client hint headers or 0 when there isn't a valid one
+func headerDPR(r *http.Request) float64 {
+	v := r.Header.Get("Sec-CH-DPR")
+	if v == "" {
+		v = r.Header.Get("DPR")
+	}
+	d, err := strconv.ParseFloat(v, 64)
+	if err != nil || d <= 0 || d > transform.MaxDPR {
+		return 0
+	}
+	return d
+}
+
+// applyDPR multiplies the requested output size by the device pixel ratio for a w by h source.
+// The resize dimensions are multiplied, or the crop size keeping its center when there is no resize.
+// The ratio is lowered when the source isn't big enough so the image is never upscaled past its 1x size.
+// pd.DPR is cleared as it is now part of the sizes, so checking the limits again doesn't count it twice.
+func applyDPR(pd *parametersData, w uint, h uint) {
+	dpr := pd.DPR
+	pd.DPR = 0
+	if dpr <= 1 {
+		return
+	}
+	d := dpr
+	crop := pd.CW > 0 && pd.CH > 0
+	if pd.RW > 0 || pd.RH > 0 {
+		if crop {
+			//the crop is what gets resized
+			w, h = pd.CW, pd.CH
+		}
+		if pd.RW > 0 {
+			d = math.Min(d, float64(w)/float64(pd.RW))
+		}
+		if pd.RH > 0 {
+			d = math.Min(d, float64(h)/float64(pd.RH))
+		}
+		if d <= 1 {
+			pd.log("Source too small for dpr " + floatToString(dpr))
+			return
+		}
+		if pd.RW > 0 {
+			pd.RW = scaleDim(pd.RW, d)
+		}
+		if pd.RH > 0 {
+			pd.RH = scaleDim(pd.RH, d)
+		}
+	} else if crop {
+		d = math.Min(d, math.Min(float64(w)/float64(pd.CW), float64(h)/float64(pd.CH)))
+		if d <= 1 {
+			pd.log("Source too small for dpr " + floatToString(dpr))
+			return
+		}
+		cw, ch := scaleDim(pd.CW, d), scaleDim(pd.CH, d)
+		pd.CX = clampInt(pd.CX-(int(cw)-int(pd.CW))/2, 0, int(w)-int(cw))
+		pd.CY = clampInt(pd.CY-(int(ch)-int(pd.CH))/2, 0, int(h)-int(ch))
+		pd.CW, pd.CH = cw, ch
+	} else {
+		return
+	}
+	pd.log("Applied dpr " + floatToString(d) + " rw=" + uintToString(pd.RW) + ", rh=" + uintToString(pd.RH) + ", cw=" + uintToString(pd.CW) + ", ch=" + uintToString(pd.CH))
+}
+
+// fitSize returns the size to scale a w by h image to for the requested rw by rh.
+// When only one of rw or rh is given the other keeps the aspect ratio whatever the fit mode.
+func fitSize(w uint, h uint, rw uint, rh uint, fit string) (uint, uint) {
+	if w == 0 || h == 0 {
+		return rw, rh
+	}
+	sw := float64(rw) / float64(w)
+	sh := float64(rh) / float64(h)
+	switch {
+	case rw > 0 && rh == 0:
+		return rw, scaleDim(h, sw)
+	case rh > 0 && rw == 0:
+		return scaleDim(w, sh), rh
+	}
+
+	switch fit {
+	case "cover", "outside":
+		if sw < sh {
+			sw = sh
+		}
+		return scaleDim(w, sw), scaleDim(h, sw)
+	case "contain", "inside":
+		if sw > sh {
+			sw = sh
+		}
+		return scaleDim(w, sw), scaleDim(h, sw)
+	}
+	return rw, rh
+}
+
+// noUpscale keeps the x by y scaled size of a w by h image from being bigger than the image.
+// fill stretches each dimension on its own so each is limited separately.
+func noUpscale(w uint, h uint, x uint, y uint, fit string) (uint, uint) {
+	if fit == "" || fit == "fill" {
+		if x > w {
+			x = w
+		}
+		if y > h {
+			y = h
+		}
+		return x, y
+	}
+	if x > w || y > h {
+		return w, h
+	}
+	return x, y
+}
+
+// scaleDim scales the dimension d rounding to the nearest pixel and never below 1
+func scaleDim(d uint, s float64) uint {
+	v := uint(float64(d)*s + 0.5)
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+// scaledSize returns the size resizeFrame scales a w by h frame to before cropping or letterboxing it
+func scaledSize(w uint, h uint, pd *parametersData) (uint, uint) {
+	x, y := fitSize(w, h, pd.RW, pd.RH, pd.Fit)
+	if !pd.Up {
+		x, y = noUpscale(w, h, x, y, pd.Fit)
+	}
+	return limitSize(x, y)
+}
+
+// resizedSize returns the size resizeFrame turns a w by h frame into
+func resizedSize(w uint, h uint, pd *parametersData) (uint, uint) {
+	x, y := scaledSize(w, h, pd)
+	if pd.RW > 0 && pd.RH > 0 {
+		switch pd.Fit {
+		case "cover":
+			//a frame that wasn't upscaled to cover the crop keeps its size
+			x, y = uint(math.Min(float64(x), float64(pd.RW))), uint(math.Min(float64(y), float64(pd.RH)))
+		case "contain":
+			x, y = pd.RW, pd.RH
+		}
+	}
+	if pd.Pad {
+		if pd.RW > 0 {
+			x = pd.RW
+		}
+		if pd.RH > 0 {
+			y = pd.RH
+		}
+	}
+	return x, y
+}
+
+// croppedSize returns the size of the crop of a w by h frame, only the part of the crop inside the frame is kept
+func croppedSize(w uint, h uint, pd *parametersData) (uint, uint) {
+	if pd.CW == 0 || pd.CH == 0 {
+		return w, h
+	}
+	x, y := pd.CX, pd.CY
+	if pd.Focal || pd.CG != "" || pd.CC {
+		//these offsets always keep as much of the crop inside the frame as fits
+		x, y = 0, 0
+	}
+	return uint(clampInt(int(w)-x, 0, int(pd.CW))), uint(clampInt(int(h)-y, 0, int(pd.CH)))
+}
+
+// outputSize returns the size generateImage makes from an upright w by h source without touching any pixels
+func outputSize(w uint, h uint, pd *parametersData) (uint, uint) {
+	w, h = croppedSize(w, h, pd)
+	if pd.RW > 0 || pd.RH > 0 {
+		w, h = resizedSize(w, h, pd)
+	}
+	return w, h
+}
+
+// resizeFrame scales the current frame of mw for the requested size and fit mode
+// then crops or letterboxes it for cover and contain and pads it when requested
+func resizeFrame(mw *imagick.MagickWand, pd *parametersData) error {
+	x, y := scaledSize(mw.GetImageWidth(), mw.GetImageHeight(), pd)
+	if err := mw.ThumbnailImage(x, y); err != nil {
+		return err
+	}
+	if pd.RW == 0 || pd.RH == 0 {
+		if err := mw.SetImagePage(x, y, 0, 0); err != nil {
+			return err
+		}
+		return padFrame(mw, pd)
+	}
+
+	switch pd.Fit {
+	case "cover":
+		//crop the overflow evenly from both sides unless a focal point or crop gravity is given
+		cx, cy := (int(x)-int(pd.RW))/2, (int(y)-int(pd.RH))/2
+		if pd.Focal {
+			cx, cy = focalOffset(x, y, pd.RW, pd.RH, pd.FX, pd.FY)
+		} else if pd.CG != "" && (!smartGravity(pd.CG) || mw.GetNumberImages() == 1) {
+			//smart gravities would pick a different region per frame of an animation so those stay centered
+			cx, cy = cropOffset(mw, pd.RW, pd.RH, pd.CG, pd)
+		}
+		if err := mw.CropImage(pd.RW, pd.RH, cx, cy); err != nil {
+			return err
+		}
+		//a frame that wasn't upscaled to cover the box keeps whatever part of it is inside the box
+		x, y = mw.GetImageWidth(), mw.GetImageHeight()
+	case "contain":
+		//center the image on a canvas of the full size
+		if err := extendFrame(mw, pd, pd.RW, pd.RH); err != nil {
+			return err
+		}
+		x, y = pd.RW, pd.RH
+	}
+	if err := mw.SetImagePage(x, y, 0, 0); err != nil {
+		return err
+	}
+	return padFrame(mw, pd)
+}
+
+// padFrame centers the current frame of mw on a canvas of the requested size
+// using the frame size for a dimension that wasn't requested
+func padFrame(mw *imagick.MagickWand, pd *parametersData) error {
+	if !pd.Pad {
+		return nil
+	}
+	w, h := pd.RW, pd.RH
+	if w == 0 {
+		w = mw.GetImageWidth()
+	}
+	if h == 0 {
+		h = mw.GetImageHeight()
+	}
+	if w == mw.GetImageWidth() && h == mw.GetImageHeight() {
+		return nil
+	}
+	if err := extendFrame(mw, pd, w, h); err != nil {
+		return err
+	}
+	return mw.SetImagePage(w, h, 0, 0)
+}
+
+// extendFrame centers the current frame of mw on a w by h canvas filled with the background color
+func extendFrame(mw *imagick.MagickWand, pd *parametersData, w uint, h uint) error {
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor(backgroundColor(mw, pd))
+	mw.SetImageBackgroundColor(pw)
+	return mw.ExtentImage(w, h, -(int(w)-int(mw.GetImageWidth()))/2, -(int(h)-int(mw.GetImageHeight()))/2)
+}
+
+// backgroundColor is the color used to fill letterboxing and padding.
+// It is the bg parameter when given otherwise transparent when the image has an alpha channel.
+// Transparency falls back to white for output formats without an alpha channel.
+func backgroundColor(mw *imagick.MagickWand, pd *parametersData) string {
+	c := pd.BG
+	if c == "" {
+		c = "white"
+		if mw.GetImageAlphaChannel() {
+			c = "none"
+		}
+	}
+	if c == "none" && !alphaFormats[pd.F] {
+		return "white"
+	}
+	return c
+}
+
+// output formats that keep transparency
+var alphaFormats = map[string]bool{
+	"png":  true,
+	"gif":  true,
+	"webp": true,
+	"avif": true,
+	"jxl":  true,
+}
@@ -0,0 +1,55 @@
+// Package signature signs and verifies image server transform paths.
+//
+// A signed path carries a sig parameter in its parameter segment:
+// /uri/rw=480:rh=320:sig={signature}/{image mgid string}
+// The signature is an HMAC-SHA256 over the route, the remaining parameter segment and the mgid
+// so neither the route, the transform nor the image can be changed without a new signature.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// Param is the name of the parameter holding the signature
+const Param = "sig"
+
+// Sign returns the url safe signature of the parameter segment p for the mgid id on the route, such as uri or manifest
+func Sign(secret []byte, route string, p string, id string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(route + "/" + p + "/" + id))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Verify reports whether sig is a valid signature of the parameter segment p for the mgid id on the route
+func Verify(secret []byte, route string, p string, id string, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(Sign(secret, route, p, id)))
+}
+
+// Split removes the signature parameter from the parameter segment p.
+// It returns the remaining parameter segment and the signature, which is empty when none is present.
+func Split(p string) (string, string) {
+	var sig string
+	var ps []string
+	for _, v := range strings.Split(p, ":") {
+		if strings.HasPrefix(v, Param+"=") {
+			sig = v[len(Param)+1:]
+			continue
+		}
+		ps = append(ps, v)
+	}
+	return strings.Join(ps, ":"), sig
+}
+
+// Path returns the path of the mgid id on the route with the signature appended to the parameter segment p,
+// /{route}/{p}:sig={signature}/{id}.  Any signature already in p is replaced.
+func Path(secret []byte, route string, p string, id string) string {
+	p, _ = Split(p)
+	sp := Param + "=" + Sign(secret, route, p, id)
+	if p != "" {
+		sp = p + ":" + sp
+	}
+	return "/" + route + "/" + sp + "/" + id
+}
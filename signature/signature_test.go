@@ -0,0 +1,53 @@
+package signature
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathVerify(t *testing.T) {
+	secret := []byte("secret")
+	id := "mgid:file:gsp:entertainment-assets:/cc/images/a.jpg"
+
+	u := Path(secret, "uri", "rw=480:q=50", id)
+	if !strings.HasPrefix(u, "/uri/rw=480:q=50:"+Param+"=") || !strings.HasSuffix(u, "/"+id) {
+		t.Fatalf("Path = %s", u)
+	}
+	p, sig := Split(strings.SplitN(u, "/", 4)[2])
+	if p != "rw=480:q=50" || sig == "" {
+		t.Fatalf("Split = %q, %q", p, sig)
+	}
+
+	tests := []struct {
+		route string
+		p     string
+		id    string
+		want  bool
+	}{
+		{"uri", p, id, true},
+		{"manifest", p, id, false},
+		{"oid", p, id, false},
+		{"uri", "rw=481:q=50", id, false},
+		{"uri", p, id + "x", false},
+	}
+	for _, tt := range tests {
+		if got := Verify(secret, tt.route, tt.p, tt.id, sig); got != tt.want {
+			t.Errorf("Verify(%s, %s, %s) = %v, want %v", tt.route, tt.p, tt.id, got, tt.want)
+		}
+	}
+	if Verify([]byte("other"), "uri", p, id, sig) {
+		t.Error("Verify with another secret = true")
+	}
+}
+
+func TestPathReplacesSignature(t *testing.T) {
+	secret := []byte("secret")
+	a := Path(secret, "uri", "rw=480", "id")
+	b := Path(secret, "uri", "rw=480:"+Param+"=stale", "id")
+	if a != b {
+		t.Errorf("Path with a stale signature = %s, want %s", b, a)
+	}
+	if got := Path(secret, "info", "", "id"); !strings.HasPrefix(got, "/info/"+Param+"=") {
+		t.Errorf("Path with no parameters = %s", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jsaterfiel/go-imagick/transform"
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// directory holding the .ttf and .otf fonts txf can pick from, set by TEXT_FONT_PATH
+var fontDir string
+
+// font name in fontDir used when txf isn't given, set by TEXT_FONT.  Empty uses the imagemagick default font
+var defaultFont string
+
+// font size used when txs isn't given in pixels
+const defaultTextSize = 24
+
+// text gravities for txg, compass points place the text against that edge or corner
+var textGravities = map[string]imagick.GravityType{
+	"n":      imagick.GRAVITY_NORTH,
+	"s":      imagick.GRAVITY_SOUTH,
+	"e":      imagick.GRAVITY_EAST,
+	"w":      imagick.GRAVITY_WEST,
+	"ne":     imagick.GRAVITY_NORTH_EAST,
+	"nw":     imagick.GRAVITY_NORTH_WEST,
+	"se":     imagick.GRAVITY_SOUTH_EAST,
+	"sw":     imagick.GRAVITY_SOUTH_WEST,
+	"center": imagick.GRAVITY_CENTER,
+}
+
+// initText sets up the fonts from the environment variables
+// TEXT_FONT_PATH - directory of the fonts that can be used by txf
+// TEXT_FONT - font name in TEXT_FONT_PATH used when txf isn't given
+func initText() error {
+	fontDir = os.Getenv("TEXT_FONT_PATH")
+	defaultFont = os.Getenv("TEXT_FONT")
+	if defaultFont == "" {
+		return nil
+	}
+	if _, ok := fontPath(defaultFont); !ok {
+		return errors.New("Invalid environment variable TEXT_FONT " + defaultFont + ", must be the name of a .ttf or .otf font in TEXT_FONT_PATH")
+	}
+	return nil
+}
+
+// fontPath returns the file of the font name in the font directory.
+// TEXT_FONT skips the txf parsing so the name is checked the same way here before it goes in a path.
+func fontPath(name string) (string, bool) {
+	if fontDir == "" || !transform.ValidName(name) {
+		return "", false
+	}
+	for _, ext := range []string{".ttf", ".otf"} {
+		fp := filepath.Join(fontDir, name+ext)
+		if fi, err := os.Stat(fp); err == nil && !fi.IsDir() {
+			return fp, true
+		}
+	}
+	return "", false
+}
+
+// newTextDrawing sets up the drawing of the txt text for the current frame of mw
+// with the lines wrapped to the txw width, or the frame width less the inset around the text
+func newTextDrawing(mw *imagick.MagickWand, pd *parametersData) (*imagick.DrawingWand, error) {
+	size := pd.Txs
+	if size == 0 {
+		size = defaultTextSize
+	}
+	//keep the text off the edges by half the font size
+	in := size / 2
+
+	dw := imagick.NewDrawingWand()
+	f := pd.Txf
+	if f == "" {
+		f = defaultFont
+	}
+	if fp, ok := fontPath(f); ok {
+		if err := dw.SetFont(fp); err != nil {
+			dw.Destroy()
+			return nil, err
+		}
+	}
+	dw.SetFontSize(size)
+	dw.SetTextAntialias(true)
+
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	c := pd.Txc
+	if c == "" {
+		c = "white"
+	}
+	pw.SetColor(c)
+	dw.SetFillColor(pw)
+	if pd.Txsw > 0 {
+		sc := pd.Txsc
+		if sc == "" {
+			sc = "black"
+		}
+		spw := imagick.NewPixelWand()
+		defer spw.Destroy()
+		spw.SetColor(sc)
+		dw.SetStrokeColor(spw)
+		dw.SetStrokeWidth(pd.Txsw)
+	}
+
+	g := pd.Txg
+	if g == "" {
+		g = "s"
+	}
+	dw.SetGravity(textGravities[g])
+
+	max := float64(mw.GetImageWidth()) - 2*in
+	if pd.Txw > 0 && float64(pd.Txw) < max {
+		max = float64(pd.Txw)
+	}
+
+	//the offset moves the text in from the gravity edges and is ignored along the centered axis
+	var x, y float64
+	if strings.ContainsAny(g, "ew") {
+		x = in
+	}
+	if strings.ContainsAny(g, "ns") {
+		y = in
+	}
+	dw.Annotation(x, y, wrapText(mw, dw, pd.Txt, max))
+	return dw, nil
+}
+
+// wrapText breaks s into lines no wider than max pixels when drawn with dw.
+// New lines in s are kept and words longer than a line get a line to themselves.
+func wrapText(mw *imagick.MagickWand, dw *imagick.DrawingWand, s string, max float64) string {
+	var ls []string
+	for _, p := range strings.Split(s, "\n") {
+		var l string
+		for _, w := range strings.Fields(p) {
+			if l == "" {
+				l = w
+				continue
+			}
+			if fm := mw.QueryFontMetrics(dw, l+" "+w); fm != nil && fm.TextWidth <= max {
+				l += " " + w
+				continue
+			}
+			ls = append(ls, l)
+			l = w
+		}
+		ls = append(ls, l)
+	}
+	return strings.Join(ls, "\n")
+}
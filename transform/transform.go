@@ -0,0 +1,555 @@
+// Package transform parses and validates the parameter segment of image server paths.
+//
+// The segment is a colon separated list of key=value parameters:
+// /uri/rw=480:rh=320:q=50/{image mgid string}
+// Values are url encoded so they can hold the : and = separators, eg txt=Breaking%3A%20News
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxSize is the largest value accepted for pixel sizes and offsets
+const MaxSize = math.MaxUint16
+
+// MaxDPR is the highest device pixel ratio accepted from dpr
+const MaxDPR = 4
+
+// MaxSigma is the largest blur and sharpen sigma accepted, the work grows with the square of the sigma
+const MaxSigma = 20
+
+// MaxTextLength is the longest text accepted by txt in characters
+const MaxTextLength = 256
+
+// MaxTextSize is the largest font size accepted by txs in pixels
+const MaxTextSize = 400
+
+// Transform is the validated set of parameters of an image request.
+// Fields are named after their parameter and the zero value means the parameter wasn't given.
+type Transform struct {
+	//resize width and height
+	RW uint
+	RH uint
+	//crop size and top left offset
+	CW uint
+	CH uint
+	CX int
+	CY int
+	//crop from the center
+	CC bool
+	//crop gravity
+	CG string
+	//focal point as fractions of the width and height, Focal is set when either was given
+	FX    float64
+	FY    float64
+	Focal bool
+	//quality 1 to 100
+	Q uint
+	//output format
+	F string
+	//normalize
+	N bool
+	//animation mode
+	AM string
+	//fit mode, background color as an imagemagick color and padding
+	Fit string
+	BG  string
+	Pad bool
+	//device pixel ratio
+	DPR float64
+	//allow upscaling
+	Up bool
+	//rotation in degrees and flip
+	Rot  float64
+	Flip string
+	//effects
+	Blur  float64
+	Sharp float64
+	Gray  bool
+	Sepia float64
+	Bri   float64
+	Con   float64
+	Sat   float64
+	Hue   float64
+	//text overlay, the colors are imagemagick colors
+	Txt  string
+	Txf  string
+	Txs  float64
+	Txc  string
+	Txsc string
+	Txsw float64
+	Txg  string
+	Txw  uint
+	//watermark overlay
+	WM  string
+	WMG string
+	WMM uint
+	WMO float64
+	WMS float64
+}
+
+// FieldError is an invalid parameter
+type FieldError struct {
+	Key   string
+	Value string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	return e.Key + "=" + e.Value + ": " + e.Msg
+}
+
+// Errors holds every invalid parameter of a segment in the order they were given
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	ms := make([]string, len(e))
+	for i, fe := range e {
+		ms[i] = fe.Error()
+	}
+	return strings.Join(ms, ", ")
+}
+
+// Parse applies the parameter segment s to t.
+// Parameters s doesn't give keep their value so a segment can be layered over another.
+// The valid parameters are applied even when others are invalid, the invalid ones are returned as Errors.
+func (t *Transform) Parse(s string) error {
+	var errs Errors
+	for _, v := range strings.Split(s, ":") {
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			errs = append(errs, &FieldError{Key: kv[0], Msg: "missing value"})
+			continue
+		}
+		uv, err := url.PathUnescape(kv[1])
+		if err != nil {
+			errs = append(errs, &FieldError{Key: kv[0], Value: kv[1], Msg: "invalid url encoding"})
+			continue
+		}
+		set, ok := setters[kv[0]]
+		if !ok {
+			errs = append(errs, &FieldError{Key: kv[0], Value: uv, Msg: "unknown parameter"})
+			continue
+		}
+		if err := set(t, uv); err != nil {
+			errs = append(errs, &FieldError{Key: kv[0], Value: uv, Msg: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// String returns the parameters in a fixed order leaving out defaults.
+// Segments that parse to the same parameters get the same string whatever order or number format was used.
+func (t *Transform) String() string {
+	var ps []string
+	add := func(k string, v string) {
+		ps = append(ps, k+"="+v)
+	}
+	if t.RW > 0 {
+		add("rw", formatUint(t.RW))
+	}
+	if t.RH > 0 {
+		add("rh", formatUint(t.RH))
+	}
+	if t.CW > 0 {
+		add("cw", formatUint(t.CW))
+	}
+	if t.CH > 0 {
+		add("ch", formatUint(t.CH))
+	}
+	if t.CX != 0 {
+		add("cx", strconv.Itoa(t.CX))
+	}
+	if t.CY != 0 {
+		add("cy", strconv.Itoa(t.CY))
+	}
+	if t.CC {
+		add("cc", "1")
+	}
+	if t.CG != "" {
+		add("cg", t.CG)
+	}
+	if t.Rot != 0 {
+		add("rot", formatFloat(t.Rot))
+	}
+	if t.Flip != "" {
+		add("flip", t.Flip)
+	}
+	if t.Up {
+		add("up", "1")
+	}
+	if t.Txt != "" {
+		add("txt", Escape(t.Txt))
+		for _, p := range []struct {
+			k string
+			v string
+		}{{"txf", t.Txf}, {"txc", strings.TrimPrefix(t.Txc, "#")}, {"txsc", strings.TrimPrefix(t.Txsc, "#")}, {"txg", t.Txg}} {
+			if p.v != "" {
+				add(p.k, p.v)
+			}
+		}
+		if t.Txs > 0 {
+			add("txs", formatFloat(t.Txs))
+		}
+		if t.Txsw > 0 {
+			add("txsw", formatFloat(t.Txsw))
+		}
+		if t.Txw > 0 {
+			add("txw", formatUint(t.Txw))
+		}
+	}
+	if t.WM != "" {
+		add("wm", t.WM)
+		if t.WMG != "" {
+			add("wmg", t.WMG)
+		}
+		if t.WMM > 0 {
+			add("wmm", formatUint(t.WMM))
+		}
+		if t.WMO > 0 {
+			add("wmo", formatFloat(t.WMO))
+		}
+		if t.WMS > 0 {
+			add("wms", formatFloat(t.WMS))
+		}
+	}
+	for _, e := range []struct {
+		k string
+		v float64
+	}{{"blur", t.Blur}, {"sharp", t.Sharp}, {"sepia", t.Sepia}, {"bri", t.Bri}, {"con", t.Con}, {"sat", t.Sat}, {"hue", t.Hue}} {
+		if e.v != 0 {
+			add(e.k, formatFloat(e.v))
+		}
+	}
+	if t.Gray {
+		add("gray", "1")
+	}
+	if t.DPR > 1 {
+		add("dpr", formatFloat(t.DPR))
+	}
+	if t.Focal {
+		add("fx", formatFloat(t.FX))
+		add("fy", formatFloat(t.FY))
+	}
+	if t.Q > 0 {
+		add("q", formatUint(t.Q))
+	}
+	if t.F != "" {
+		add("f", t.F)
+	}
+	if t.N {
+		add("n", "1")
+	}
+	if t.AM != "" {
+		add("am", t.AM)
+	}
+	if t.Fit != "" && t.Fit != "fill" {
+		add("fit", t.Fit)
+	}
+	if t.BG != "" {
+		add("bg", strings.TrimPrefix(t.BG, "#"))
+	}
+	if t.Pad {
+		add("pad", "1")
+	}
+	return strings.Join(ps, ":")
+}
+
+// Escape url encodes the parameter value v including the : and = separators
+func Escape(v string) string {
+	return strings.NewReplacer(":", "%3A", "=", "%3D").Replace(url.PathEscape(v))
+}
+
+func formatUint(v uint) string {
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// setters validate a parameter value and set it on the transform
+var setters = map[string]func(t *Transform, v string) error{
+	"rw":   func(t *Transform, v string) (err error) { t.RW, err = parseSize(v); return },
+	"rh":   func(t *Transform, v string) (err error) { t.RH, err = parseSize(v); return },
+	"cw":   func(t *Transform, v string) (err error) { t.CW, err = parseSize(v); return },
+	"ch":   func(t *Transform, v string) (err error) { t.CH, err = parseSize(v); return },
+	"cx":   func(t *Transform, v string) (err error) { t.CX, err = parseOffset(v); return },
+	"cy":   func(t *Transform, v string) (err error) { t.CY, err = parseOffset(v); return },
+	"cc":   func(t *Transform, v string) (err error) { t.CC, err = parseBool(v); return },
+	"n":    func(t *Transform, v string) (err error) { t.N, err = parseBool(v); return },
+	"pad":  func(t *Transform, v string) (err error) { t.Pad, err = parseBool(v); return },
+	"up":   func(t *Transform, v string) (err error) { t.Up, err = parseBool(v); return },
+	"gray": func(t *Transform, v string) (err error) { t.Gray, err = parseBool(v); return },
+	"q":    func(t *Transform, v string) (err error) { t.Q, err = parseQuality(v); return },
+	"f": func(t *Transform, v string) error {
+		f, ok := formats[strings.ToLower(v)]
+		if !ok {
+			return errors.New("must be jpg, png, gif, webp, avif or jxl")
+		}
+		t.F = f
+		return nil
+	},
+	"am": func(t *Transform, v string) error {
+		if v != "s" && v != "p" {
+			return errors.New("must be s or p")
+		}
+		t.AM = v
+		return nil
+	},
+	"fit": func(t *Transform, v string) error {
+		if !fitModes[v] {
+			return errors.New("must be cover, contain, fill, inside or outside")
+		}
+		t.Fit = v
+		return nil
+	},
+	"bg":   func(t *Transform, v string) (err error) { t.BG, err = ParseColor(v); return },
+	"txc":  func(t *Transform, v string) (err error) { t.Txc, err = ParseColor(v); return },
+	"txsc": func(t *Transform, v string) (err error) { t.Txsc, err = ParseColor(v); return },
+	"cg": func(t *Transform, v string) error {
+		if !compass[v] && v != "entropy" && v != "attention" {
+			return errors.New("must be n, s, e, w, ne, nw, se, sw, center, entropy or attention")
+		}
+		t.CG = v
+		return nil
+	},
+	"txg": func(t *Transform, v string) (err error) { t.Txg, err = parseCompass(v); return },
+	"wmg": func(t *Transform, v string) (err error) { t.WMG, err = parseCompass(v); return },
+	"fx":  func(t *Transform, v string) error { return t.setFocal(&t.FX, v) },
+	"fy":  func(t *Transform, v string) error { return t.setFocal(&t.FY, v) },
+	"dpr": func(t *Transform, v string) error {
+		d, err := strconv.ParseFloat(v, 64)
+		if err != nil || d <= 0 || d > MaxDPR {
+			return fmt.Errorf("must be a number over 0 up to %d", MaxDPR)
+		}
+		t.DPR = d
+		return nil
+	},
+	"rot": func(t *Transform, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= -360 || f >= 360 {
+			return errors.New("must be degrees between -360 and 360")
+		}
+		t.Rot = f
+		return nil
+	},
+	"flip": func(t *Transform, v string) error {
+		switch v {
+		case "h", "v", "hv":
+			t.Flip = v
+		case "vh":
+			t.Flip = "hv"
+		default:
+			return errors.New("must be h, v or hv")
+		}
+		return nil
+	},
+	"blur":  func(t *Transform, v string) (err error) { t.Blur, err = parseRange(v, 0, MaxSigma); return },
+	"sharp": func(t *Transform, v string) (err error) { t.Sharp, err = parseRange(v, 0, MaxSigma); return },
+	"sepia": func(t *Transform, v string) (err error) { t.Sepia, err = parseRange(v, 0, 100); return },
+	"bri":   func(t *Transform, v string) (err error) { t.Bri, err = parseRange(v, -100, 100); return },
+	"con":   func(t *Transform, v string) (err error) { t.Con, err = parseRange(v, -100, 100); return },
+	"sat":   func(t *Transform, v string) (err error) { t.Sat, err = parseRange(v, -100, 100); return },
+	"hue":   func(t *Transform, v string) (err error) { t.Hue, err = parseRange(v, -180, 180); return },
+	"txt":   func(t *Transform, v string) (err error) { t.Txt, err = parseText(v); return },
+	"txf":   func(t *Transform, v string) (err error) { t.Txf, err = parseName(v); return },
+	"txs":   func(t *Transform, v string) (err error) { t.Txs, err = parseRange(v, 1, MaxTextSize); return },
+	"txsw":  func(t *Transform, v string) (err error) { t.Txsw, err = parseRange(v, 0, 20); return },
+	"txw":   func(t *Transform, v string) (err error) { t.Txw, err = parseSize(v); return },
+	"wm":    func(t *Transform, v string) (err error) { t.WM, err = parseName(v); return },
+	"wmm":   func(t *Transform, v string) (err error) { t.WMM, err = parseSize(v); return },
+	"wmo":   func(t *Transform, v string) (err error) { t.WMO, err = parseRange(v, 1, 100); return },
+	"wms": func(t *Transform, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			return errors.New("must be a fraction over 0 up to 1")
+		}
+		t.WMS = f
+		return nil
+	},
+}
+
+// output formats for f
+var formats = map[string]string{
+	"jpg":  "jpg",
+	"jpeg": "jpg",
+	"png":  "png",
+	"gif":  "gif",
+	"webp": "webp",
+	"avif": "avif",
+	"jxl":  "jxl",
+}
+
+// fit modes for resizing when both rw and rh are given
+var fitModes = map[string]bool{
+	//scale to cover both dimensions then crop the overflow
+	"cover": true,
+	//scale to fit inside both dimensions then letterbox to the full size
+	"contain": true,
+	//stretch to both dimensions ignoring the aspect ratio, the default
+	"fill": true,
+	//scale to fit inside both dimensions, the result may be smaller than requested
+	"inside": true,
+	//scale to cover both dimensions, the result may be larger than requested
+	"outside": true,
+}
+
+// compass gravities keep or place things against that edge or corner
+var compass = map[string]bool{
+	"n":      true,
+	"s":      true,
+	"e":      true,
+	"w":      true,
+	"ne":     true,
+	"nw":     true,
+	"se":     true,
+	"sw":     true,
+	"center": true,
+}
+
+// names of fonts and watermarks end up in file paths and origin keys so only simple names are allowed
+var name = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var hexColor = regexp.MustCompile(`^([0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+var namedColor = regexp.MustCompile(`^[a-zA-Z]+[0-9]*$`)
+
+// ParseColor converts a color parameter into an imagemagick color.
+// Hex colors are given without the # as it starts the url fragment and win over names like bad or fed.
+func ParseColor(v string) (string, error) {
+	switch {
+	case v == "transparent" || v == "none":
+		return "none", nil
+	case hexColor.MatchString(v):
+		return "#" + strings.ToLower(v), nil
+	case namedColor.MatchString(v):
+		return strings.ToLower(v), nil
+	}
+	return "", errors.New("must be a hex color without the # or a color name")
+}
+
+// parseSize parses a whole number of pixels
+func parseSize(v string) (uint, error) {
+	if strings.HasPrefix(v, "-") {
+		return 0, errors.New("can't be negative")
+	}
+	i, err := strconv.ParseUint(v, 10, 16)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return 0, fmt.Errorf("can't be over %d", MaxSize)
+		}
+		return 0, errors.New("must be a whole number of pixels")
+	}
+	return uint(i), nil
+}
+
+// parseOffset parses a crop offset which has to be inside the image
+func parseOffset(v string) (int, error) {
+	i, err := parseSize(v)
+	return int(i), err
+}
+
+func parseBool(v string) (bool, error) {
+	switch v {
+	case "1", "true":
+		return true, nil
+	case "0", "false":
+		return false, nil
+	}
+	return false, errors.New("must be 1 or 0")
+}
+
+// parseQuality parses q as a percentage from 1 to 100 or with a decimal point as a fraction of 1.
+// So q=50 and q=0.5 are both 50 while q=1 is 1 and q=1.0 is 100.
+func parseQuality(v string) (uint, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errors.New("must be a percentage from 1 to 100 or a fraction like 0.9")
+	}
+	if strings.Contains(v, ".") {
+		f *= 100
+	}
+	q := math.Floor(f + 0.5)
+	if q < 1 || q > 100 {
+		return 0, errors.New("must be a percentage from 1 to 100 or a fraction like 0.9")
+	}
+	return uint(q), nil
+}
+
+// parseRange parses a number from min to max
+func parseRange(v string, min float64, max float64) (float64, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || f < min || f > max {
+		return 0, fmt.Errorf("must be a number from %s to %s", formatFloat(min), formatFloat(max))
+	}
+	return f, nil
+}
+
+func parseCompass(v string) (string, error) {
+	if !compass[v] {
+		return "", errors.New("must be n, s, e, w, ne, nw, se, sw or center")
+	}
+	return v, nil
+}
+
+// ValidName reports whether v is a font or watermark name that is safe to put in a file path
+func ValidName(v string) bool {
+	return name.MatchString(v)
+}
+
+func parseName(v string) (string, error) {
+	if !ValidName(v) {
+		return "", errors.New("must be letters, numbers, _ or -")
+	}
+	return v, nil
+}
+
+// parseText checks the txt value.
+// Control characters other than new lines are dropped and a leading @ is refused
+// as imagemagick can treat it as a file to read the text from.
+func parseText(v string) (string, error) {
+	if !utf8.ValidString(v) || utf8.RuneCountInString(v) > MaxTextLength {
+		return "", fmt.Errorf("must be utf-8 text up to %d characters", MaxTextLength)
+	}
+	if strings.HasPrefix(v, "@") {
+		return "", errors.New("can't start with @")
+	}
+	t := strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, v)
+	if strings.TrimSpace(t) == "" {
+		return "", errors.New("can't be blank")
+	}
+	return t, nil
+}
+
+// setFocal sets one focal point coordinate, a missing coordinate stays in the middle
+func (t *Transform) setFocal(c *float64, v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		return errors.New("must be a fraction from 0 to 1")
+	}
+	if !t.Focal {
+		t.FX, t.FY, t.Focal = 0.5, 0.5, true
+	}
+	*c = f
+	return nil
+}
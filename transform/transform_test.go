@@ -0,0 +1,248 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var tr Transform
+	err := tr.Parse("rw=480:rh=320:cx=10:cy=20:cw=100:ch=50:q=0.5:f=JPEG:fit=cover:bg=FF0000:txt=Breaking%3A%20News:fx=0.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Transform{RW: 480, RH: 320, CX: 10, CY: 20, CW: 100, CH: 50, Q: 50, F: "jpg", Fit: "cover", BG: "#ff0000", Txt: "Breaking: News", FX: 0.25, FY: 0.5, Focal: true}
+	if tr != want {
+		t.Errorf("Parse = %+v, want %+v", tr, want)
+	}
+}
+
+func TestParseLayers(t *testing.T) {
+	var tr Transform
+	if err := tr.Parse("rw=480:rh=320:q=50"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Parse("q=80"); err != nil {
+		t.Fatal(err)
+	}
+	if tr.RW != 480 || tr.RH != 320 || tr.Q != 80 {
+		t.Errorf("layered Parse = %+v, want rw=480 rh=320 q=80", tr)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		s    string
+		errs []FieldError
+		//parameters that are still applied
+		want Transform
+	}{
+		{s: "rw", errs: []FieldError{{Key: "rw", Msg: "missing value"}}},
+		{s: "zz=1", errs: []FieldError{{Key: "zz", Value: "1", Msg: "unknown parameter"}}},
+		{s: "txt=%zz", errs: []FieldError{{Key: "txt", Value: "%zz", Msg: "invalid url encoding"}}},
+		{s: "rw=-10", errs: []FieldError{{Key: "rw", Value: "-10", Msg: "can't be negative"}}},
+		{s: "rw=65536", errs: []FieldError{{Key: "rw", Value: "65536", Msg: "can't be over 65535"}}},
+		{s: "cx=-1", errs: []FieldError{{Key: "cx", Value: "-1", Msg: "can't be negative"}}},
+		{s: "f=bmp", errs: []FieldError{{Key: "f", Value: "bmp", Msg: "must be jpg, png, gif, webp, avif or jxl"}}},
+		{s: "fx=1.5", errs: []FieldError{{Key: "fx", Value: "1.5", Msg: "must be a fraction from 0 to 1"}}},
+		{s: "blur=21", errs: []FieldError{{Key: "blur", Value: "21", Msg: "must be a number from 0 to 20"}}},
+		{s: "sharp=100", errs: []FieldError{{Key: "sharp", Value: "100", Msg: "must be a number from 0 to 20"}}},
+		{s: "dpr=5", errs: []FieldError{{Key: "dpr", Value: "5", Msg: "must be a number over 0 up to 4"}}},
+		{s: "txt=@%2Fetc%2Fpasswd", errs: []FieldError{{Key: "txt", Value: "@/etc/passwd", Msg: "can't start with @"}}},
+		{s: "wm=..%2Flogo", errs: []FieldError{{Key: "wm", Value: "../logo", Msg: "must be letters, numbers, _ or -"}}},
+		{
+			s: "rw=abc:rh=320:q=0:cc=2",
+			errs: []FieldError{
+				{Key: "rw", Value: "abc", Msg: "must be a whole number of pixels"},
+				{Key: "q", Value: "0", Msg: "must be a percentage from 1 to 100 or a fraction like 0.9"},
+				{Key: "cc", Value: "2", Msg: "must be 1 or 0"},
+			},
+			want: Transform{RH: 320},
+		},
+	}
+	for _, tt := range tests {
+		var tr Transform
+		err := tr.Parse(tt.s)
+		errs, ok := err.(Errors)
+		if !ok {
+			t.Errorf("Parse(%q) error = %v, want Errors", tt.s, err)
+			continue
+		}
+		if len(errs) != len(tt.errs) {
+			t.Errorf("Parse(%q) = %v, want %d errors", tt.s, errs, len(tt.errs))
+			continue
+		}
+		for i, fe := range errs {
+			if *fe != tt.errs[i] {
+				t.Errorf("Parse(%q) error %d = %+v, want %+v", tt.s, i, *fe, tt.errs[i])
+			}
+		}
+		if tr != tt.want {
+			t.Errorf("Parse(%q) applied %+v, want %+v", tt.s, tr, tt.want)
+		}
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"rw=480:rh=320:q=50",
+		"cw=800:ch=600:cx=200:cy=100:rw=400:fit=cover:fx=0.3:fy=0.7",
+		"rw=320:cg=attention:f=webp:am=p:n=1:up=1:dpr=2.5",
+		"rw=640:rot=90:flip=hv:blur=2:sharp=1.5:gray=1:sepia=80:bri=-10:con=20:sat=-5:hue=45",
+		"rw=480:rh=480:fit=contain:bg=transparent:pad=1",
+		"rw=480:txt=Breaking%3A%20News%3D100%25%0Anow:txf=DejaVuSans:txs=32:txc=fff:txsc=black:txsw=2:txg=ne:txw=300",
+		"rw=480:wm=logo:wmg=sw:wmm=10:wmo=50:wms=0.25",
+	}
+	for _, s := range tests {
+		var a Transform
+		if err := a.Parse(s); err != nil {
+			t.Errorf("Parse(%q): %v", s, err)
+			continue
+		}
+		cs := a.String()
+		var b Transform
+		if err := b.Parse(cs); err != nil {
+			t.Errorf("Parse(String() %q): %v", cs, err)
+			continue
+		}
+		if a != b {
+			t.Errorf("round trip of %q through %q = %+v, want %+v", s, cs, b, a)
+		}
+		if b.String() != cs {
+			t.Errorf("String() of %q = %q then %q", s, cs, b.String())
+		}
+	}
+}
+
+func TestStringCanonical(t *testing.T) {
+	tests := []struct {
+		a string
+		b string
+	}{
+		{"rw=480:q=50", "q=0.5:rw=480"},
+		{"q=100", "q=1.0"},
+		{"rw=0480:f=jpeg", "f=JPG:rw=480"},
+		{"fit=fill:rw=10:rh=10", "rw=10:rh=10"},
+		{"dpr=1:rw=10", "rw=10"},
+		{"flip=vh", "flip=hv"},
+		{"bg=FFF", "bg=fff"},
+		{"fy=0.5:fx=0.2", "fx=0.2"},
+	}
+	for _, tt := range tests {
+		var a, b Transform
+		if err := a.Parse(tt.a); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Parse(tt.b); err != nil {
+			t.Fatal(err)
+		}
+		if a.String() != b.String() {
+			t.Errorf("%q.String() = %q, %q.String() = %q, want the same", tt.a, a.String(), tt.b, b.String())
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		v    string
+		want string
+	}{
+		{"plain", "plain"},
+		{"a:b=c", "a%3Ab%3Dc"},
+		{"two words", "two%20words"},
+		{"100%", "100%25"},
+		{"a/b", "a%2Fb"},
+		{"line\nbreak", "line%0Abreak"},
+		{"café", "caf%C3%A9"},
+	}
+	for _, tt := range tests {
+		e := Escape(tt.v)
+		if e != tt.want {
+			t.Errorf("Escape(%q) = %q, want %q", tt.v, e, tt.want)
+		}
+		if strings.ContainsAny(e, ":=") {
+			t.Errorf("Escape(%q) = %q still holds a separator", tt.v, e)
+		}
+		var tr Transform
+		if err := tr.Parse("txt=" + e); err != nil {
+			t.Errorf("Parse(txt=%s): %v", e, err)
+		} else if tr.Txt != tt.v {
+			t.Errorf("Parse(txt=%s) = %q, want %q", e, tr.Txt, tt.v)
+		}
+	}
+}
+
+func TestParseQuality(t *testing.T) {
+	tests := []struct {
+		v    string
+		want uint
+		err  bool
+	}{
+		{v: "1", want: 1},
+		{v: "50", want: 50},
+		{v: "100", want: 100},
+		{v: "0.9", want: 90},
+		{v: "0.5", want: 50},
+		{v: ".75", want: 75},
+		{v: "1.0", want: 100},
+		{v: "0.01", want: 1},
+		{v: "0", err: true},
+		{v: "0.0", err: true},
+		{v: "101", err: true},
+		{v: "1.5", err: true},
+		{v: "-50", err: true},
+		{v: "NaN", err: true},
+		{v: "high", err: true},
+	}
+	for _, tt := range tests {
+		q, err := parseQuality(tt.v)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseQuality(%q) = %d, want an error", tt.v, q)
+			}
+			continue
+		}
+		if err != nil || q != tt.want {
+			t.Errorf("parseQuality(%q) = %d, %v, want %d", tt.v, q, err, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		v    string
+		want uint
+		err  string
+	}{
+		{v: "0", want: 0},
+		{v: "480", want: 480},
+		{v: "65535", want: MaxSize},
+		{v: "65536", err: "can't be over 65535"},
+		{v: "99999999999999999999", err: "can't be over 65535"},
+		{v: "-1", err: "can't be negative"},
+		{v: "-65536", err: "can't be negative"},
+		{v: "1.5", err: "must be a whole number of pixels"},
+		{v: "", err: "must be a whole number of pixels"},
+		{v: "+5", err: "must be a whole number of pixels"},
+	}
+	for _, tt := range tests {
+		s, err := parseSize(tt.v)
+		o, oerr := parseOffset(tt.v)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseSize(%q) = %d, %v, want error %q", tt.v, s, err, tt.err)
+			}
+			if oerr == nil || oerr.Error() != tt.err {
+				t.Errorf("parseOffset(%q) = %d, %v, want error %q", tt.v, o, oerr, tt.err)
+			}
+			continue
+		}
+		if err != nil || s != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.v, s, err, tt.want)
+		}
+		if oerr != nil || o != int(tt.want) {
+			t.Errorf("parseOffset(%q) = %d, %v, want %d", tt.v, o, oerr, tt.want)
+		}
+	}
+}
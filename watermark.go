@@ -0,0 +1,77 @@
+package main
+
+import (
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// origin key prefix of the overlays for wm, wm=logo is the png at {prefix}logo.png
+var watermarkPrefix = "watermarks/"
+
+// loadWatermark reads the wm overlay through the local volume and origin like any other image.
+// Only the first frame of an animated overlay is used.
+func loadWatermark(pd *parametersData) (*imagick.MagickWand, error) {
+	i, _, err := loadImage(watermarkPrefix+pd.WM+".png", pd)
+	if err != nil {
+		ie := toImageError(err)
+		if ie.kind == errKindNotFound {
+			return nil, newImageError(errKindBadParams, "Unknown watermark "+pd.WM, err)
+		}
+		return nil, ie
+	}
+
+	wm := imagick.NewMagickWand()
+	if err := wm.ReadImageBlob(i); err != nil {
+		wm.Destroy()
+		return nil, newImageError(errKindProcessing, "Failed to read watermark "+pd.WM, err)
+	}
+	wm.SetFirstIterator()
+	if err := wm.AutoOrientImage(); err != nil {
+		wm.Destroy()
+		return nil, newImageError(errKindProcessing, "Failed to read watermark "+pd.WM, err)
+	}
+	return wm, nil
+}
+
+// scaleWatermark scales the overlay wm from loadWatermark and applies the opacity for a w by h image
+func scaleWatermark(wm *imagick.MagickWand, w uint, h uint, pd *parametersData) error {
+	//scale relative to the image width and never past the space left inside the margins
+	ww, wh := wm.GetImageWidth(), wm.GetImageHeight()
+	s := 1.0
+	if pd.WMS > 0 {
+		s = pd.WMS * float64(w) / float64(ww)
+	}
+	if sw := int(w) - 2*int(pd.WMM); sw > 0 && float64(ww)*s > float64(sw) {
+		s = float64(sw) / float64(ww)
+	}
+	if sh := int(h) - 2*int(pd.WMM); sh > 0 && float64(wh)*s > float64(sh) {
+		s = float64(sh) / float64(wh)
+	}
+	if s != 1 {
+		if err := wm.ResizeImage(scaleDim(ww, s), scaleDim(wh, s), imagick.FILTER_LANCZOS); err != nil {
+			return newImageError(errKindProcessing, "Failed to scale watermark "+pd.WM, err)
+		}
+	}
+
+	if pd.WMO > 0 && pd.WMO < 100 {
+		//make sure there is an alpha channel to fade then multiply it down
+		wm.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET)
+		cm := wm.SetImageChannelMask(imagick.CHANNEL_ALPHA)
+		err := wm.EvaluateImage(imagick.EVAL_OP_MULTIPLY, pd.WMO/100)
+		wm.SetImageChannelMask(cm)
+		if err != nil {
+			return newImageError(errKindProcessing, "Failed to fade watermark "+pd.WM, err)
+		}
+	}
+	return nil
+}
+
+// watermarkFrame composites wm over the current frame of mw at the wmg corner inset by the wmm margin
+func watermarkFrame(mw *imagick.MagickWand, wm *imagick.MagickWand, pd *parametersData) error {
+	g := pd.WMG
+	if g == "" {
+		g = "se"
+	}
+	m := int(pd.WMM)
+	x, y := gravityOffset(int(mw.GetImageWidth())-int(wm.GetImageWidth())-2*m, int(mw.GetImageHeight())-int(wm.GetImageHeight())-2*m, g)
+	return mw.CompositeImage(wm, imagick.COMPOSITE_OP_OVER, true, x+m, y+m)
+}